@@ -0,0 +1,250 @@
+package callbacks
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/sifer169966/go-xds/metrics"
+	otelmetric "go.opentelemetry.io/otel/metric"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	reasonUnauthenticated = "unauthenticated"
+	reasonNodeID          = "node_id"
+	reasonNamespace       = "namespace"
+)
+
+// AuthzPolicy ... the identities that are allowed to open the streams and the nodes and namespaces that each of them may use
+type AuthzPolicy struct {
+	Rules []AuthzRule `json:"rules"`
+}
+
+// AuthzRule ...
+// allows the clients of an identity to use the node ids and to see the namespaces,
+// a client is allowed if any rule of its identity allows it
+type AuthzRule struct {
+	// Identity is the SPIFFE ID of the URI SAN of the client certificate, a trailing /* matches every ID of the prefix
+	Identity string `json:"identity,omitempty"`
+	// TokenSHA256 is the hex sha256 digest of the bearer token of the `authorization` metadata that authenticates the rule
+	// instead of a certificate, the token itself is never written into the policy
+	TokenSHA256 string `json:"tokenSHA256,omitempty"`
+	// NodeIDs are the node ids that the clients may use, a trailing * matches every id of the prefix
+	NodeIDs []string `json:"nodeIDs"`
+	// Namespaces are the namespaces that the snapshot group of the node may see besides the shared ones, * or empty means any.
+	// a restricted rule only allows the groups of which namespaces are known, i.e. the namespace isolation must be enabled
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+// LoadAuthzPolicy ... read the policy from a yaml or json file
+func LoadAuthzPolicy(path string) (AuthzPolicy, error) {
+	var out AuthzPolicy
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return out, err
+	}
+	err = yaml.UnmarshalStrict(content, &out)
+	if err != nil {
+		return out, err
+	}
+	for i, rule := range out.Rules {
+		if (rule.Identity == "") == (rule.TokenSHA256 == "") {
+			return out, fmt.Errorf("rule %d must have either an identity or a token digest", i)
+		}
+		if rule.TokenSHA256 != "" {
+			if _, err := hex.DecodeString(rule.TokenSHA256); err != nil || len(rule.TokenSHA256) != sha256.Size*2 {
+				return out, fmt.Errorf("rule %d has an invalid token digest", i)
+			}
+		}
+	}
+	return out, nil
+}
+
+// Authorizer ...
+// authenticates the client of each stream on its open and authorizes the node of each of its requests by the policy,
+// the rejected streams are closed by PermissionDenied
+type Authorizer struct {
+	policy   AuthzPolicy
+	nodeHash cachev3.NodeHash
+	// namespaces are the namespaces that a snapshot group sees besides the shared ones, nil if every group sees every namespace
+	namespaces func(group string) []string
+	// streams are the *streamAuthz of each open stream by its streamKey
+	streams         sync.Map
+	rejectedCounter otelmetric.Int64Counter
+}
+
+// streamKey ... the sotw and the delta streams are counted separately, so their ids could be the same
+type streamKey struct {
+	delta bool
+	id    int64
+}
+
+// streamAuthz ... the rules that match the client of a stream and the node that it has been authorized with
+type streamAuthz struct {
+	rules []AuthzRule
+	node  *corev3.Node
+}
+
+// NewAuthorizer ...
+// create a new instance of *Authorizer, the nodeHash and the namespaces resolve the namespaces of the node by its snapshot group
+func NewAuthorizer(policy AuthzPolicy, nodeHash cachev3.NodeHash, namespaces func(group string) []string) *Authorizer {
+	out := &Authorizer{
+		policy:     policy,
+		nodeHash:   nodeHash,
+		namespaces: namespaces,
+	}
+	out.rejectedCounter, _ = metrics.GetGlobalMeter().Int64Counter("xds_server_authz_rejections")
+	return out
+}
+
+// open ... authenticate the client of the stream by its certificate or its bearer token
+func (a *Authorizer) open(ctx context.Context, key streamKey) error {
+	rules := a.matchRules(ctx)
+	if len(rules) == 0 {
+		return a.reject(key, reasonUnauthenticated, "the client is not allowed by any rule")
+	}
+	a.streams.Store(key, &streamAuthz{rules: rules})
+	return nil
+}
+
+// closed ... forget the rules of the stream
+func (a *Authorizer) closed(key streamKey) {
+	a.streams.Delete(key)
+}
+
+// authorize ...
+// whether the client of the stream may use the node and see the namespaces of its group. the delta requests are called back
+// before the server fills in the node, which is only sent by the first request, so a request without one is authorized
+// by the node of the stream and the node is only checked again when it is changed
+func (a *Authorizer) authorize(key streamKey, node *corev3.Node) error {
+	v, ok := a.streams.Load(key)
+	if !ok {
+		return a.reject(key, reasonUnauthenticated, "the stream has not been authenticated")
+	}
+	stream := v.(*streamAuthz)
+	if node == nil {
+		node = stream.node
+	}
+	if stream.node != nil && proto.Equal(node, stream.node) {
+		return nil
+	}
+	reason := reasonNodeID
+	for _, rule := range stream.rules {
+		if !slices.ContainsFunc(rule.NodeIDs, func(pattern string) bool {
+			return matchPattern(pattern, node.GetId())
+		}) {
+			continue
+		}
+		if a.allowsNamespaces(rule, node) {
+			// the requests of a stream are called back one by one
+			stream.node = node
+			return nil
+		}
+		reason = reasonNamespace
+	}
+	return a.reject(key, reason, fmt.Sprintf("node %q is not allowed", node.GetId()))
+}
+
+// allowsNamespaces ... whether the rule allows every namespace that the group of the node sees
+func (a *Authorizer) allowsNamespaces(rule AuthzRule, node *corev3.Node) bool {
+	if len(rule.Namespaces) == 0 || slices.Contains(rule.Namespaces, "*") {
+		return true
+	}
+	if a.namespaces == nil {
+		// the node would see every namespace
+		return false
+	}
+	for _, ns := range a.namespaces(a.nodeHash.ID(node)) {
+		if !slices.Contains(rule.Namespaces, ns) {
+			return false
+		}
+	}
+	return true
+}
+
+// reject ... count the rejection and the error that closes the stream
+func (a *Authorizer) reject(key streamKey, reason string, msg string) error {
+	a.rejectedCounter.Add(context.Background(), 1, otelmetric.WithAttributes(metrics.ReasonAttrKey.String(reason)))
+	klog.Warning("stream is rejected", "streamID", key.id, "delta", key.delta, "reason", reason, "msg", msg)
+	return status.Error(codes.PermissionDenied, msg)
+}
+
+// matchRules ... the rules that match the SPIFFE ID of the verified client certificate or the bearer token of the stream
+func (a *Authorizer) matchRules(ctx context.Context) []AuthzRule {
+	spiffeIDs := peerSPIFFEIDs(ctx)
+	tokenDigest := bearerTokenDigest(ctx)
+	var out []AuthzRule
+	for _, rule := range a.policy.Rules {
+		switch {
+		case rule.Identity != "":
+			if slices.ContainsFunc(spiffeIDs, func(id string) bool {
+				return matchPattern(rule.Identity, id)
+			}) {
+				out = append(out, rule)
+			}
+		case tokenDigest != nil:
+			expected, _ := hex.DecodeString(rule.TokenSHA256)
+			if subtle.ConstantTimeCompare(expected, tokenDigest) == 1 {
+				out = append(out, rule)
+			}
+		}
+	}
+	return out
+}
+
+// peerSPIFFEIDs ... the SPIFFE IDs of the URI SANs of the client certificate, it must have been verified by the client CAs
+func peerSPIFFEIDs(ctx context.Context) []string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	var out []string
+	for _, uri := range info.State.VerifiedChains[0][0].URIs {
+		if uri.Scheme == "spiffe" {
+			out = append(out, uri.String())
+		}
+	}
+	return out
+}
+
+// bearerTokenDigest ... the sha256 digest of the bearer token of the `authorization` metadata, nil if there is none
+func bearerTokenDigest(ctx context.Context) []byte {
+	values := metadata.ValueFromIncomingContext(ctx, "authorization")
+	if len(values) == 0 {
+		return nil
+	}
+	token, ok := strings.CutPrefix(values[0], "Bearer ")
+	if !ok || token == "" {
+		return nil
+	}
+	digest := sha256.Sum256([]byte(token))
+	return digest[:]
+}
+
+// matchPattern ... whether the value equals the pattern or starts with its prefix before a trailing *
+func matchPattern(pattern string, value string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(value, prefix)
+	}
+	return pattern == value
+}
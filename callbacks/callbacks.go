@@ -11,7 +11,8 @@ import (
 	"k8s.io/klog/v2"
 )
 
-func New() xds.CallbackFuncs {
+// New ... the callbacks of the xds server, every stream is authorized by the authz unless it is nil
+func New(authz *Authorizer) xds.CallbackFuncs {
 	meter := metrics.GetGlobalMeter()
 	streamConnsGauge, _ := meter.Int64UpDownCounter("xds_server_stream_conns")
 	deltaConnsGauge, _ := meter.Int64UpDownCounter("xds_server_delta_stream_conns")
@@ -21,24 +22,45 @@ func New() xds.CallbackFuncs {
 		StreamOpenFunc: func(ctx context.Context, streamID int64, typeURL string) error {
 			streamConnsGauge.Add(ctx, 1)
 			klog.Info("StreamOpen", "streamID", streamID, "typeURL", typeURL)
+			if authz != nil {
+				return authz.open(ctx, streamKey{id: streamID})
+			}
 			return nil
 		},
 		StreamClosedFunc: func(streamID int64, node *corev3.Node) {
 			streamConnsGauge.Add(context.Background(), -1)
 			klog.Info("StreamClosed", "streamID", streamID)
+			if authz != nil {
+				authz.closed(streamKey{id: streamID})
+			}
 		},
 		DeltaStreamOpenFunc: func(ctx context.Context, streamID int64, typeURL string) error {
 			deltaConnsGauge.Add(ctx, 1)
 			klog.Info("DeltaStreamOpen", "streamID", streamID, "typeURL", typeURL)
+			if authz != nil {
+				return authz.open(ctx, streamKey{delta: true, id: streamID})
+			}
 			return nil
 		},
 		DeltaStreamClosedFunc: func(streamID int64, node *corev3.Node) {
 			deltaConnsGauge.Add(context.Background(), -1)
 			klog.Info("DeltaStreamClosed", "streamID", streamID)
+			if authz != nil {
+				authz.closed(streamKey{delta: true, id: streamID})
+			}
 		},
 		StreamRequestFunc: func(streamID int64, request *discoverygrpc.DiscoveryRequest) error {
 			requestCounter.Add(context.Background(), 1, otelmetric.WithAttributes(metrics.TypeURLAttrKey.String(request.GetTypeUrl())))
 			klog.Info("StreamRequest", "streamID", streamID, "request", request)
+			if authz != nil {
+				return authz.authorize(streamKey{id: streamID}, request.GetNode())
+			}
+			return nil
+		},
+		StreamDeltaRequestFunc: func(streamID int64, request *discoverygrpc.DeltaDiscoveryRequest) error {
+			if authz != nil {
+				return authz.authorize(streamKey{delta: true, id: streamID}, request.GetNode())
+			}
 			return nil
 		},
 		StreamResponseFunc: func(ctx context.Context, streamID int64, request *discoverygrpc.DiscoveryRequest, response *discoverygrpc.DiscoveryResponse) {
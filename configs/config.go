@@ -1,7 +1,9 @@
 package configs
 
 import (
+	"fmt"
 	"log"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,6 +15,10 @@ type Config struct {
 	App           App
 	Deployment    Deployment
 	MonitorServer MonitorServer
+	ServerTLS     ServerTLS
+	Authz         Authz
+	Reflector     Reflector
+	Snapshot      Snapshot
 }
 
 type App struct {
@@ -30,6 +36,210 @@ type MonitorServer struct {
 	ReadHeaderTimeout time.Duration `envconfig:"MONITOR_SERVER_READ_HEADER_TIMEOUT" default:"15s"`
 }
 
+// ServerTLS ... tls configuration of the xds gRPC listener, it serves in plaintext unless the CertFile is set
+type ServerTLS struct {
+	// CertFile and KeyFile are the PEM files of the certificate of the server, they are reloaded whenever they are changed
+	CertFile string `envconfig:"SERVER_TLS_CERT_FILE"`
+	KeyFile  string `envconfig:"SERVER_TLS_KEY_FILE"`
+	// ClientCAFile is the PEM file of the CAs that verify the certificates of the clients, it enables the mTLS
+	ClientCAFile string `envconfig:"SERVER_TLS_CLIENT_CA_FILE"`
+	// RequireClientCert rejects the clients that have no certificate signed by the ClientCAFile
+	RequireClientCert bool `envconfig:"SERVER_TLS_REQUIRE_CLIENT_CERT" default:"false"`
+	// ReloadInterval is the interval to check the modification of the files
+	ReloadInterval time.Duration `envconfig:"SERVER_TLS_RELOAD_INTERVAL" default:"10s"`
+}
+
+// Authz ... authorization of the xds clients, every client is allowed unless the PolicyFile is set
+type Authz struct {
+	// PolicyFile is the yaml or json file of the policy that maps the SPIFFE IDs of the client certificates or the bearer tokens
+	// into the node ids and the namespaces that they are allowed to use
+	PolicyFile string `envconfig:"AUTHZ_POLICY_FILE"`
+}
+
+// Reflector ... k8s reflectors configuration
+type Reflector struct {
+	// EndpointsAPI selects the k8s API used to discover the endpoints, either `endpoints` or `endpointslices`
+	EndpointsAPI string `envconfig:"REFLECTOR_ENDPOINTS_API" default:"endpoints"`
+	// TopologyFromNodes groups the endpoints into localities by the topology labels of their nodes
+	TopologyFromNodes bool `envconfig:"REFLECTOR_TOPOLOGY_FROM_NODES" default:"false"`
+	// WatchPods looks up the pods of the endpoints to read their weights,
+	// the legacy endpoints API always looks them up to detect the terminating pods
+	WatchPods bool `envconfig:"REFLECTOR_WATCH_PODS" default:"false"`
+	// WeightFromCPURequests derives the weight of an endpoint from the cpu requests of its pod when it has no weight annotation
+	WeightFromCPURequests bool `envconfig:"REFLECTOR_WEIGHT_FROM_CPU_REQUESTS" default:"false"`
+	// ResyncPeriod is the period of the reflectors to resync their caches
+	ResyncPeriod time.Duration `envconfig:"REFLECTOR_RESYNC_PERIOD" default:"5m"`
+	// Namespaces is a comma separated allow list of the namespaces to watch, empty means all namespaces
+	Namespaces []string `envconfig:"REFLECTOR_NAMESPACES"`
+	// ExcludedNamespaces is a comma separated deny list of the namespaces to not watch
+	ExcludedNamespaces []string `envconfig:"REFLECTOR_EXCLUDED_NAMESPACES"`
+	// LabelSelector filters the services and their endpoints by their labels
+	LabelSelector string `envconfig:"REFLECTOR_LABEL_SELECTOR"`
+	// FieldSelector filters the services and their endpoints by their fields
+	FieldSelector string `envconfig:"REFLECTOR_FIELD_SELECTOR"`
+	// RequireOptIn only translates the services that are annotated by `xds.go-xds.io/export: "true"`
+	RequireOptIn bool `envconfig:"REFLECTOR_REQUIRE_OPT_IN" default:"false"`
+	// ClusterNameTemplate is the template of the cluster names, the placeholders are
+	// {service}, {namespace}, {port} (the port name or the port number if it is unnamed), {port_name} and {port_number}
+	ClusterNameTemplate string `envconfig:"REFLECTOR_CLUSTER_NAME_TEMPLATE" default:"{service}.{namespace}:{port}"`
+	// GatewayRoutes reflects the Gateway API HTTPRoutes and GRPCRoutes that are attached to the services,
+	// it requires the Gateway API CRDs to be installed
+	GatewayRoutes bool `envconfig:"REFLECTOR_GATEWAY_ROUTES" default:"false"`
+	// Secrets serves the `kubernetes.io/tls` secrets that are labeled by `xds.go-xds.io/sds: "true"` over sds,
+	// it requires the permission to list and watch the secrets, and either the SNAPSHOT_NAMESPACE_ISOLATION or the AUTHZ_POLICY_FILE
+	Secrets bool `envconfig:"REFLECTOR_SECRETS" default:"false"`
+	// DebounceWindow coalesces the bursts of changes into one snapshot update until there has been no change for the window, 0s disables it
+	DebounceWindow time.Duration `envconfig:"REFLECTOR_DEBOUNCE_WINDOW" default:"100ms"`
+	// DebounceMaxDelay is the maximum delay of a snapshot update since the first change that it coalesces
+	DebounceMaxDelay time.Duration `envconfig:"REFLECTOR_DEBOUNCE_MAX_DELAY" default:"1s"`
+	// SyncTimeout restarts a reflector of which caches have not been synced within it, 0s waits forever
+	SyncTimeout time.Duration `envconfig:"REFLECTOR_SYNC_TIMEOUT" default:"2m"`
+	// RestartInitialBackoff is the delay of the first restart of a failed reflector, it is doubled by each consecutive failure
+	RestartInitialBackoff time.Duration `envconfig:"REFLECTOR_RESTART_INITIAL_BACKOFF" default:"1s"`
+	// RestartMaxBackoff bounds the delay of the restarts of a failed reflector
+	RestartMaxBackoff time.Duration `envconfig:"REFLECTOR_RESTART_MAX_BACKOFF" default:"1m"`
+	// RestartMaxFailures is the number of the consecutive failures of a reflector before the server gives up and stops, 0 means no limit
+	RestartMaxFailures int `envconfig:"REFLECTOR_RESTART_MAX_FAILURES" default:"0"`
+	// MonotonicVersions prefixes the content hash versions of the snapshots by the number of the pushes of each reflector,
+	// the versions are ordered but they are not the same on every replica anymore
+	MonotonicVersions bool `envconfig:"REFLECTOR_MONOTONIC_VERSIONS" default:"false"`
+	// ServerListeners serves the inbound listeners of the pods of the services that are annotated by
+	// `xds.go-xds.io/server-listeners: "true"` to the grpc xds servers, their pods are read by the EndpointsAPI
+	ServerListeners bool `envconfig:"REFLECTOR_SERVER_LISTENERS" default:"false"`
+	// ServerListenerNameTemplate is the server_listener_resource_name_template of the grpc xds servers, %s is the ip:port of a pod
+	ServerListenerNameTemplate string `envconfig:"REFLECTOR_SERVER_LISTENER_NAME_TEMPLATE" default:"grpc/server?xds.resource.listening_address=%s"`
+	// MTLSNamespaces is a comma separated list of the namespaces of which services are served by the mTLS of the proxyless grpc
+	// certificate providers unless they are annotated by `xds.go-xds.io/mtls: "false"`, * means every namespace.
+	// the pods are watched to verify the service accounts of the pods of the services, it requires the permission to list and watch the pods
+	MTLSNamespaces []string `envconfig:"REFLECTOR_MTLS_NAMESPACES"`
+	// MTLSCertProviderInstance is the instance name of the certificate provider of the own certificates of the grpc clients and servers
+	MTLSCertProviderInstance string `envconfig:"REFLECTOR_MTLS_CERT_PROVIDER_INSTANCE" default:"default"`
+	// MTLSCAProviderInstance is the instance name of the certificate provider of the root certificates, default to the MTLSCertProviderInstance
+	MTLSCAProviderInstance string `envconfig:"REFLECTOR_MTLS_CA_PROVIDER_INSTANCE"`
+	// MTLSTrustDomain is the trust domain of the SPIFFE IDs of the service accounts that the peers are verified by
+	MTLSTrustDomain string `envconfig:"REFLECTOR_MTLS_TRUST_DOMAIN" default:"cluster.local"`
+	// LocalClusterName names the locality of the endpoints of the k8s cluster that the server runs in,
+	// it is only used when there are RemoteClusters
+	LocalClusterName string `envconfig:"REFLECTOR_LOCAL_CLUSTER_NAME" default:"local"`
+	// LocalClusterPriority is the failover priority of the endpoints of the local k8s cluster, the lowest one is preferred
+	LocalClusterPriority uint32 `envconfig:"REFLECTOR_LOCAL_CLUSTER_PRIORITY" default:"0"`
+	// RemoteClusters are the other k8s clusters of which endpoints are merged with the local ones,
+	// the services of their endpoints are resolved from the local cluster and the readiness does not wait for them
+	RemoteClusters RemoteClusters `envconfig:"REFLECTOR_REMOTE_CLUSTERS"`
+	// StaticResourcesDir is the directory of the hand-written envoy resources in the .yaml, .yml or .json files,
+	// they override the ones of the k8s reflectors. nothing is loaded if it is empty or until the directory exists
+	StaticResourcesDir string `envconfig:"REFLECTOR_STATIC_RESOURCES_DIR"`
+	// StaticResourcesPollInterval is the interval to check the modification of the files of the StaticResourcesDir
+	StaticResourcesPollInterval time.Duration `envconfig:"REFLECTOR_STATIC_RESOURCES_POLL_INTERVAL" default:"5s"`
+}
+
+// RemoteCluster ... a k8s cluster of which endpoints are discovered by its own reflector
+type RemoteCluster struct {
+	// Name names the locality of the endpoints of the cluster
+	Name string
+	// Kubeconfig is the path of the kubeconfig file, the default loading rules are used if it is empty
+	Kubeconfig string
+	// Context is the context of the kubeconfig, the current context is used if it is empty
+	Context string
+	// Priority is the failover priority of the endpoints of the cluster, the lowest one is preferred
+	Priority uint32
+}
+
+// RemoteClusters ...
+// the `;` separated list of the remote clusters of which fields are `,` separated key=value pairs, e.g.
+// name=east,kubeconfig=/etc/xds/east.yaml,priority=1;name=west,context=west-admin,priority=1
+type RemoteClusters []RemoteCluster
+
+// Decode ... decode the remote clusters from the environment variable
+func (r *RemoteClusters) Decode(value string) error {
+	*r = nil
+	for _, entry := range strings.Split(value, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		var cluster RemoteCluster
+		for _, field := range strings.Split(entry, ",") {
+			k, v, ok := strings.Cut(strings.TrimSpace(field), "=")
+			if !ok {
+				return fmt.Errorf("invalid remote cluster field %q", field)
+			}
+			switch k {
+			case "name":
+				cluster.Name = v
+			case "kubeconfig":
+				cluster.Kubeconfig = v
+			case "context":
+				cluster.Context = v
+			case "priority":
+				priority, err := strconv.ParseUint(v, 10, 32)
+				if err != nil {
+					return fmt.Errorf("invalid remote cluster priority %q: %w", v, err)
+				}
+				cluster.Priority = uint32(priority)
+			default:
+				return fmt.Errorf("unknown remote cluster field %q", k)
+			}
+		}
+		if cluster.Name == "" {
+			return fmt.Errorf("remote cluster %q has no name", entry)
+		}
+		*r = append(*r, cluster)
+	}
+	return nil
+}
+
+// Snapshot ... the grouping of the clients into the snapshots
+type Snapshot struct {
+	// NodeHash groups the clients that share the same snapshot by their node, either `default` (every client shares one snapshot),
+	// `id`, `cluster`, `metadata` or `locality`
+	NodeHash string `envconfig:"SNAPSHOT_NODE_HASH" default:"default"`
+	// NodeHashMetadataKey is the key of the node metadata of which string value groups the clients by the `metadata` NodeHash
+	NodeHashMetadataKey string `envconfig:"SNAPSHOT_NODE_HASH_METADATA_KEY" default:"namespace"`
+	// NamespaceIsolation only lets each group see the services of its namespaces,
+	// they are the namespace of the group name unless the group has its own GroupNamespaces
+	NamespaceIsolation bool `envconfig:"SNAPSHOT_NAMESPACE_ISOLATION" default:"false"`
+	// SharedNamespaces is a comma separated list of the namespaces that are visible to every group
+	SharedNamespaces []string `envconfig:"SNAPSHOT_SHARED_NAMESPACES"`
+	// GroupNamespaces are the namespaces that each group sees
+	GroupNamespaces GroupNamespaces `envconfig:"SNAPSHOT_GROUP_NAMESPACES"`
+	// LinearClusters serves the clusters of the delta clients by their own versions as the endpoints, so only the changed ones are sent to them.
+	// the SotW clients always get every cluster
+	LinearClusters bool `envconfig:"SNAPSHOT_LINEAR_CLUSTERS" default:"false"`
+	// GroupIdleTTL evicts a group and its snapshots once its clients have had no stream for it, e.g. the groups of the pods
+	// that are gone when the clients are grouped by their node id. 0s never evicts them
+	GroupIdleTTL time.Duration `envconfig:"SNAPSHOT_GROUP_IDLE_TTL" default:"5m"`
+	// PersistDir persists the resources into the directory to serve the last good ones on boot until the reflectors have synced,
+	// nothing is persisted if it is empty
+	PersistDir string `envconfig:"SNAPSHOT_PERSIST_DIR"`
+	// PersistMaxAge is the maximum age of the persisted resources to be served, 0s means no limit
+	PersistMaxAge time.Duration `envconfig:"SNAPSHOT_PERSIST_MAX_AGE" default:"1h"`
+}
+
+// GroupNamespaces ...
+// the `;` separated list of the groups and the `|` separated namespaces that each of them sees, e.g.
+// team-a=payment|billing;team-b=search
+type GroupNamespaces map[string][]string
+
+// Decode ... decode the namespaces of the groups from the environment variable
+func (g *GroupNamespaces) Decode(value string) error {
+	*g = GroupNamespaces{}
+	for _, entry := range strings.Split(value, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		group, namespaces, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || group == "" {
+			return fmt.Errorf("invalid group namespaces %q", entry)
+		}
+		for _, ns := range strings.Split(namespaces, "|") {
+			if ns = strings.TrimSpace(ns); ns != "" {
+				(*g)[group] = append((*g)[group], ns)
+			}
+		}
+	}
+	return nil
+}
+
 func ReadENV(cfg *Config) {
 	err := godotenv.Load()
 	if err != nil {
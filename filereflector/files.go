@@ -0,0 +1,291 @@
+package filereflector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	resourcev3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/sifer169966/go-xds/metrics"
+	"github.com/sifer169966/go-xds/reflector"
+	"github.com/sifer169966/go-xds/snapshots"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/anypb"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+// invalidFileCounter ... the number of the loads of the files that are invalid
+var invalidFileCounter, _ = metrics.GetGlobalMeter().Int64Counter("xds_file_reflector_invalid_files")
+
+// servedTypes ... the types of the resources that could be loaded from the files
+var servedTypes = []string{
+	resourcev3.ListenerType,
+	resourcev3.RouteType,
+	resourcev3.ClusterType,
+	resourcev3.EndpointType,
+}
+
+// Config ... file reflector configuration
+type Config struct {
+	// Dir is the directory of the .yaml, .yml and .json files of the resources, the sub directories are not read
+	Dir string
+	// PollInterval is the interval to check the modification of the files
+	PollInterval time.Duration
+}
+
+// FileReflector ...
+// loads the hand-written envoy v3 resources from the files of a directory and reloads them whenever the files are changed,
+// a missing directory has no resources until it is created. a file has either a resource, a list of resources,
+// or an object of which `resources` field is a list of resources, and each resource is an Any in the proto3 json mapping, i.e. it is typed by its `@type`.
+// each file is loaded separately, an invalid file keeps its last valid resources and does not affect the other files
+type FileReflector struct {
+	snap  snapshots.SnapshotSetter
+	cfg   Config
+	files map[string]*loadedFile
+	// dirMissing is whether the directory did not exist by the last poll, to only warn about it once
+	dirMissing bool
+}
+
+// loadedFile ... the last valid resources of a file and the modification of the file that has been loaded
+type loadedFile struct {
+	modTime   time.Time
+	size      int64
+	content   []byte
+	resources []types.Resource
+	err       error
+}
+
+// NewFileReflector ... create a new instance of *FileReflector
+func NewFileReflector(s snapshots.SnapshotSetter, cfg Config) *FileReflector {
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = 5 * time.Second
+	}
+	return &FileReflector{
+		snap:  s,
+		cfg:   cfg,
+		files: map[string]*loadedFile{},
+	}
+}
+
+// Watch ... load the files and reload them whenever they are changed until the ctx is done
+func (r *FileReflector) Watch(ctx context.Context) error {
+	klog.Info("starting file reflector", "dir", r.cfg.Dir)
+	// the files are loaded again from scratch whenever the reflector is restarted
+	r.files = map[string]*loadedFile{}
+	_, err := r.poll(ctx)
+	if err != nil {
+		return err
+	}
+	r.push(ctx)
+	ticker := time.NewTicker(r.cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			klog.Warning("file reflector has been stopped")
+			return nil
+		case <-ticker.C:
+		}
+		changed, err := r.poll(ctx)
+		if err != nil {
+			return err
+		}
+		if changed {
+			r.push(ctx)
+		}
+	}
+}
+
+// poll ... load the files that have been changed since the last poll and report whether the resources have been changed
+func (r *FileReflector) poll(ctx context.Context) (bool, error) {
+	entries, err := os.ReadDir(r.cfg.Dir)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		// the directory may not have been mounted yet, e.g. an optional ConfigMap, so there is no resource until it is
+		if !r.dirMissing {
+			klog.Warning("the directory of the resources does not exist, no resource is loaded until it does", "dir", r.cfg.Dir)
+		}
+		r.dirMissing = true
+	case err != nil:
+		return false, fmt.Errorf("could not read the directory of the resources: %w", err)
+	default:
+		r.dirMissing = false
+	}
+	changed := false
+	seen := map[string]struct{}{}
+	for _, entry := range entries {
+		if entry.IsDir() || !isResourceFile(entry.Name()) {
+			continue
+		}
+		path := filepath.Join(r.cfg.Dir, entry.Name())
+		seen[path] = struct{}{}
+		// follow the symlinks, e.g. the files of a mounted ConfigMap link to the ones of its current data directory,
+		// which are replaced by the new ones on each update while the links themselves are never changed
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			// the file has been removed since the directory was read, or it links to a directory
+			continue
+		}
+		previous, ok := r.files[path]
+		if ok && previous.modTime.Equal(info.ModTime()) && previous.size == info.Size() {
+			continue
+		}
+		if r.load(ctx, path, info) {
+			changed = true
+		}
+	}
+	for path := range r.files {
+		if _, ok := seen[path]; !ok {
+			klog.Info("resource file has been removed", "file", path)
+			delete(r.files, path)
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+// load ... load the file and report whether its resources have been changed, the last valid resources are kept if it is invalid
+func (r *FileReflector) load(ctx context.Context, path string, info os.FileInfo) bool {
+	file, ok := r.files[path]
+	if !ok {
+		file = &loadedFile{}
+		r.files[path] = file
+	}
+	file.modTime = info.ModTime()
+	file.size = info.Size()
+	content, err := os.ReadFile(path)
+	if err == nil && bytes.Equal(content, file.content) {
+		return false
+	}
+	var resources []types.Resource
+	if err == nil {
+		resources, err = parseResources(content)
+	}
+	if err != nil {
+		file.err = err
+		invalidFileCounter.Add(ctx, 1)
+		reflector.ReportError(ctx, fmt.Errorf("invalid resource file %s, its last valid resources are kept: %w", path, err))
+		return false
+	}
+	klog.Info("resource file has been loaded", "file", path, "resources", len(resources))
+	file.content = content
+	file.resources = resources
+	file.err = nil
+	return true
+}
+
+// push ... set the resources of every file, the version is the hash of the contents of the files
+func (r *FileReflector) push(ctx context.Context) {
+	paths := make([]string, 0, len(r.files))
+	for path := range r.files {
+		paths = append(paths, path)
+	}
+	slices.Sort(paths)
+	h := xxhash.New()
+	names := map[string]string{}
+	var resources []types.Resource
+	for _, path := range paths {
+		file := r.files[path]
+		h.WriteString(path)
+		h.Write(file.content)
+		for _, res := range file.resources {
+			name := cachev3.GetResourceName(res) + "@" + string(res.ProtoReflect().Descriptor().FullName())
+			if other, ok := names[name]; ok {
+				klog.Warning("resource is defined by several files, the one of the latter file is used", "resource", name, "file", path, "otherFile", other)
+			}
+			names[name] = path
+			resources = append(resources, res)
+		}
+	}
+	r.snap.Set(ctx, strconv.FormatUint(h.Sum64(), 16), resources)
+}
+
+// isResourceFile ... whether the file is a resource file by its extension, the hidden files, e.g. the temporary ones of the editors, are skipped
+func isResourceFile(name string) bool {
+	if strings.HasPrefix(name, ".") {
+		return false
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml", ".json":
+		return true
+	default:
+		return false
+	}
+}
+
+// parseResources ... parse and validate the resources of the content of a file, the yaml is converted into json first
+func parseResources(content []byte) ([]types.Resource, error) {
+	content, err := yaml.YAMLToJSON(content)
+	if err != nil {
+		return nil, err
+	}
+	content = bytes.TrimSpace(content)
+	var raws []json.RawMessage
+	switch {
+	case bytes.Equal(content, []byte("null")):
+		// an empty file
+	case bytes.HasPrefix(content, []byte("[")):
+		err = json.Unmarshal(content, &raws)
+	default:
+		var object struct {
+			Type      string            `json:"@type"`
+			Resources []json.RawMessage `json:"resources"`
+		}
+		err = json.Unmarshal(content, &object)
+		if object.Type != "" {
+			raws = []json.RawMessage{content}
+		} else {
+			raws = object.Resources
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	out := make([]types.Resource, 0, len(raws))
+	for i, raw := range raws {
+		res, err := parseResource(raw)
+		if err != nil {
+			return nil, fmt.Errorf("resource %d: %w", i, err)
+		}
+		out = append(out, res)
+	}
+	return out, nil
+}
+
+// parseResource ... parse a resource that is typed by its `@type` and validate it
+func parseResource(raw json.RawMessage) (types.Resource, error) {
+	a := &anypb.Any{}
+	err := protojson.Unmarshal(raw, a)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(servedTypes, a.GetTypeUrl()) {
+		return nil, fmt.Errorf("type %q is not served", a.GetTypeUrl())
+	}
+	res, err := a.UnmarshalNew()
+	if err != nil {
+		return nil, err
+	}
+	if cachev3.GetResourceName(res) == "" {
+		return nil, errors.New("resource has no name")
+	}
+	if v, ok := res.(interface{ ValidateAll() error }); ok {
+		err = v.ValidateAll()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,248 @@
+package k8sreflector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sifer169966/go-xds/metrics"
+	otelmetric "go.opentelemetry.io/otel/metric"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// AnnotationPrefix ... the prefix of every annotation that is read by the reflectors
+const AnnotationPrefix = "xds.go-xds.io/"
+
+const (
+	// AnnotationPublishUnreadyEndpoints ... whether the not ready and terminating addresses of a service are published
+	// with UNHEALTHY and DRAINING health status respectively, default to false that only publishes the ready addresses
+	AnnotationPublishUnreadyEndpoints = AnnotationPrefix + "publish-unready-endpoints"
+	// AnnotationExport ... whether a service and its endpoints are translated into xds resources,
+	// it opts the service in when ReflectorConfig.RequireOptIn, otherwise it opts the service out by false
+	AnnotationExport = AnnotationPrefix + "export"
+	// AnnotationLbPolicy ... the load balancing policy of the clusters, one of ROUND_ROBIN, LEAST_REQUEST, RING_HASH, RANDOM or MAGLEV
+	AnnotationLbPolicy = AnnotationPrefix + "lb-policy"
+	// AnnotationConnectTimeout ... the timeout of the new connections to the endpoints of the clusters, e.g. 500ms
+	AnnotationConnectTimeout = AnnotationPrefix + "connect-timeout"
+	// AnnotationMaxRequests ... the circuit breaker threshold of the parallel requests to the clusters
+	AnnotationMaxRequests = AnnotationPrefix + "max-requests"
+	// AnnotationMaxPendingRequests ... the circuit breaker threshold of the pending requests to the clusters
+	AnnotationMaxPendingRequests = AnnotationPrefix + "max-pending-requests"
+	// AnnotationMaxRetries ... the circuit breaker threshold of the parallel retries to the clusters
+	AnnotationMaxRetries = AnnotationPrefix + "max-retries"
+	// AnnotationTimeout ... the timeout of the requests to the routes, e.g. 5s
+	AnnotationTimeout = AnnotationPrefix + "timeout"
+	// AnnotationMaxStreamDuration ... the maximum duration of the streams to the routes, e.g. 30m
+	AnnotationMaxStreamDuration = AnnotationPrefix + "max-stream-duration"
+	// AnnotationRetryOn ... the comma separated conditions to retry the requests on, e.g. unavailable,cancelled.
+	// the other retry annotations are ignored without it
+	AnnotationRetryOn = AnnotationPrefix + "retry-on"
+	// AnnotationNumRetries ... the number of retries of a request
+	AnnotationNumRetries = AnnotationPrefix + "num-retries"
+	// AnnotationRetryBackoffBaseInterval ... the base interval of the exponential backoff between the retries, e.g. 25ms
+	AnnotationRetryBackoffBaseInterval = AnnotationPrefix + "retry-backoff-base-interval"
+	// AnnotationRetryBackoffMaxInterval ... the maximum interval of the exponential backoff between the retries, e.g. 250ms
+	AnnotationRetryBackoffMaxInterval = AnnotationPrefix + "retry-backoff-max-interval"
+	// AnnotationDNSClusterType ... the cluster type of an ExternalName service, either LOGICAL_DNS or STRICT_DNS, default to LOGICAL_DNS
+	AnnotationDNSClusterType = AnnotationPrefix + "dns-cluster-type"
+	// AnnotationExternalNamePort ... the port of the DNS cluster of an ExternalName service that has no ports, e.g. 443.
+	// an ExternalName service without ports is not translated without it
+	AnnotationExternalNamePort = AnnotationPrefix + "external-name-port"
+	// AnnotationMTLS ... whether the clusters of a service are served by mTLS, default to whether its namespace is one of the MTLSConfig.Namespaces
+	AnnotationMTLS = AnnotationPrefix + "mtls"
+	// AnnotationServiceAccounts ... the comma separated service accounts of the pods of a service that the mTLS clients verify,
+	// default to the service accounts of the pods that the service selects, or any service account of its namespace if they are unknown
+	AnnotationServiceAccounts = AnnotationPrefix + "service-accounts"
+	// AnnotationServerListeners ... whether the pods of a service are grpc xds servers that get their inbound listeners, default to false
+	AnnotationServerListeners = AnnotationPrefix + "server-listeners"
+	// AnnotationAllowedClients ... the comma separated <namespace>/<service account> of the clients that the server listeners of a service allow,
+	// <namespace>/* allows every service account of the namespace. every client is allowed without it.
+	// it is ignored unless the service is served by mTLS, since the clients are authenticated by their certificates
+	AnnotationAllowedClients = AnnotationPrefix + "allowed-clients"
+	// AnnotationWeight ... the load balancing weight of the endpoint of a pod, it is read from the pods rather than the services
+	AnnotationWeight = AnnotationPrefix + "weight"
+)
+
+var (
+	errNotPositive             = errors.New("must be greater than zero")
+	errInvalidPort             = errors.New("must be a port number")
+	errMissingExternalNamePort = errors.New("an ExternalName service without ports needs the annotation to be translated")
+)
+
+// invalidAnnotationCounter ... count the invalid annotation values that have been ignored by the translation, each of them once
+var invalidAnnotationCounter, _ = metrics.GetGlobalMeter().Int64Counter("xds_reflector_invalid_annotations")
+
+// annotationReports ...
+// the invalid annotations that the last and the current translation of a key have reported, by the object/annotation to the resource version/value.
+// an invalid annotation is only reported again once the last translation has not found it with the same resource version and value,
+// so the reports of the objects that are gone, or that have been fixed, are dropped by the next translation
+type annotationReports struct {
+	last    map[string]string
+	current map[string]string
+}
+
+// next ... the reports of the next translation of the key, a nil one has reported nothing yet
+func (r *annotationReports) next() *annotationReports {
+	out := &annotationReports{current: map[string]string{}}
+	if r != nil {
+		out.last = r.current
+	}
+	return out
+}
+
+// annotations ... the annotations that are read by the reflectors of an object
+type annotations struct {
+	// object is the namespace/name of the annotated object to report the invalid values
+	object string
+	// resourceVersion is the resource version of the annotated object to report each invalid value once
+	resourceVersion string
+	values          map[string]string
+	// reports is the invalid annotations that have been reported by the translation, every invalid value is reported without it
+	reports *annotationReports
+}
+
+func newAnnotations(obj metav1.Object) annotations {
+	return annotations{
+		object:          obj.GetNamespace() + "/" + obj.GetName(),
+		resourceVersion: obj.GetResourceVersion(),
+		values:          xdsAnnotations(obj.GetAnnotations()),
+	}
+}
+
+// xdsAnnotations ... filter the annotations that are read by the reflectors
+func xdsAnnotations(annotations map[string]string) map[string]string {
+	out := map[string]string{}
+	for k, v := range annotations {
+		if strings.HasPrefix(k, AnnotationPrefix) {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// xdsAnnotationsChanged ... report whether any of the annotations that are read by the reflectors has been changed
+func xdsAnnotationsChanged(oldAnnotations, newAnnotations map[string]string) bool {
+	return !maps.Equal(xdsAnnotations(oldAnnotations), xdsAnnotations(newAnnotations))
+}
+
+// invalid ... report the invalid value of the annotation in the logs and the metrics once for each resource version of the object
+func (a annotations) invalid(key string, err error) {
+	if a.reports != nil {
+		reportKey := a.object + "/" + key
+		reported := a.resourceVersion + "/" + a.values[key]
+		if a.reports.current[reportKey] == reported {
+			return
+		}
+		a.reports.current[reportKey] = reported
+		if a.reports.last[reportKey] == reported {
+			return
+		}
+	}
+	klog.Error("invalid annotation value, the annotation is ignored", "object", a.object, "annotation", key, "value", a.values[key], "err", err)
+	invalidAnnotationCounter.Add(context.Background(), 1, otelmetric.WithAttributes(metrics.AnnotationAttrKey.String(key)))
+}
+
+// bool ... parse the annotation as a boolean, fallback to the default value if it is absent or invalid
+func (a annotations) bool(key string, defaultValue bool) bool {
+	v, ok := a.values[key]
+	if !ok {
+		return defaultValue
+	}
+	out, err := strconv.ParseBool(v)
+	if err != nil {
+		a.invalid(key, err)
+		return defaultValue
+	}
+	return out
+}
+
+// uint32 ... parse the annotation as a positive integer, return nil if it is absent or invalid
+func (a annotations) uint32(key string) *wrapperspb.UInt32Value {
+	v, ok := a.values[key]
+	if !ok {
+		return nil
+	}
+	out, err := strconv.ParseUint(v, 10, 32)
+	if err == nil && out == 0 {
+		err = errNotPositive
+	}
+	if err != nil {
+		a.invalid(key, err)
+		return nil
+	}
+	return wrapperspb.UInt32(uint32(out))
+}
+
+// duration ... parse the annotation as a positive duration, return nil if it is absent or invalid
+func (a annotations) duration(key string) *durationpb.Duration {
+	v, ok := a.values[key]
+	if !ok {
+		return nil
+	}
+	out, err := time.ParseDuration(v)
+	if err == nil && out <= 0 {
+		err = errNotPositive
+	}
+	if err != nil {
+		a.invalid(key, err)
+		return nil
+	}
+	return durationpb.New(out)
+}
+
+// enum ... parse the annotation as one of the allowed names case-insensitively, `-` and `_` are interchangeable.
+// return false if it is absent or invalid
+func (a annotations) enum(key string, allowed map[string]int32) (int32, bool) {
+	v, ok := a.values[key]
+	if !ok {
+		return 0, false
+	}
+	out, ok := allowed[strings.ReplaceAll(strings.ToUpper(v), "-", "_")]
+	if !ok {
+		a.invalid(key, errors.New("unknown value"))
+		return 0, false
+	}
+	return out, true
+}
+
+// list ... parse the annotation as a comma separated list of the allowed values, return nil if it is absent or invalid
+func (a annotations) list(key string, allowed []string) []string {
+	v, ok := a.values[key]
+	if !ok {
+		return nil
+	}
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if !slices.Contains(allowed, item) {
+			a.invalid(key, fmt.Errorf("unknown value %q", item))
+			return nil
+		}
+		out = append(out, item)
+	}
+	return out
+}
+
+// names ... parse the annotation as a comma separated list of the names, return nil if it is absent
+func (a annotations) names(key string) []string {
+	var out []string
+	for _, name := range strings.Split(a.values[key], ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// isExported ... report whether the annotated service has to be translated
+func (a annotations) isExported(requireOptIn bool) bool {
+	return a.bool(AnnotationExport, !requireOptIn)
+}
@@ -1,17 +1,127 @@
 package k8sreflector
 
 import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
 	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 )
 
 // ReflectorConfig ... reflector configuration
 type ReflectorConfig struct {
 	ResyncPeriod time.Duration
+	// EndpointSlices reads the endpoints from the discovery.k8s.io/v1 EndpointSlices instead of the legacy Endpoints
+	EndpointSlices bool
+	// TopologyFromNodes resolves the locality of the endpoints from the `topology.kubernetes.io/*` labels of their nodes,
+	// it requires the permission to list and watch the nodes
+	TopologyFromNodes bool
+	// WatchPods resolves the target pods of the endpoint addresses to read their weights,
+	// it requires the permission to list and watch the pods. the legacy endpoints always watch the pods to detect the terminating ones
+	WatchPods bool
+	// WeightFromCPURequests derives the weight of an endpoint from the cpu requests of its pod
+	// when the pod has no weight annotation, it implies the WatchPods
+	WeightFromCPURequests bool
+	// Namespaces is the allow list of the namespaces to watch, each of them is watched separately
+	// so that only namespaced permissions are needed. empty means all namespaces
+	Namespaces []string
+	// ExcludedNamespaces is the deny list of the namespaces that must not be watched
+	ExcludedNamespaces []string
+	// LabelSelector filters the services and their endpoints by their labels
+	LabelSelector string
+	// FieldSelector filters the services, the endpoints or the endpoint slices by their fields
+	FieldSelector string
+	// RequireOptIn only translates the services that are annotated by AnnotationExport=true,
+	// otherwise every service is translated unless it is annotated by AnnotationExport=false
+	RequireOptIn bool
+	// ClusterNameTemplate is the template of the cluster names, see DefaultClusterNameTemplate
+	ClusterNameTemplate string
+	// DebounceWindow coalesces the pushes of a reflector into one snapshot update until there has been no push for the window,
+	// zero disables it
+	DebounceWindow time.Duration
+	// DebounceMaxDelay bounds the delay of a snapshot update since the first push that it coalesces
+	DebounceMaxDelay time.Duration
+	// SyncTimeout fails the reflector if its caches have not been synced within it, e.g. when the k8s API is unreachable
+	// or the permissions are missing, so that it is restarted by its supervisor. zero waits forever
+	SyncTimeout time.Duration
+	// MonotonicVersions prefixes the content hash versions by the number of the pushes of the reflector,
+	// the versions are ordered but they are different on each replica
+	MonotonicVersions bool
+	// ServerListenerNameTemplate is the server_listener_resource_name_template of the grpc xds servers,
+	// the %s is replaced by the ip:port of each of their pods, see DefaultServerListenerNameTemplate
+	ServerListenerNameTemplate string
+	// MTLS serves the clusters of the services by the mTLS of the certificate providers of the proxyless grpc clients
+	MTLS MTLSConfig
 }
 
 func (r ReflectorConfig) defaultConfigure() ReflectorConfig {
 	if r.ResyncPeriod == 0 {
 		r.ResyncPeriod = 5 * time.Minute
 	}
+	if r.ClusterNameTemplate == "" {
+		r.ClusterNameTemplate = DefaultClusterNameTemplate
+	}
+	if r.ServerListenerNameTemplate == "" {
+		r.ServerListenerNameTemplate = DefaultServerListenerNameTemplate
+	}
+	r.MTLS = r.MTLS.defaultConfigure()
 	return r
 }
+
+// Validate ... validate the selectors and the templates of the configuration
+func (r ReflectorConfig) Validate() error {
+	if err := validateClusterNameTemplate(r.defaultConfigure().ClusterNameTemplate); err != nil {
+		return err
+	}
+	if !strings.Contains(r.defaultConfigure().ServerListenerNameTemplate, "%s") {
+		return errors.New("server listener name template has no %s of the listening address")
+	}
+	if _, err := labels.Parse(r.LabelSelector); err != nil {
+		return fmt.Errorf("invalid label selector: %w", err)
+	}
+	if _, err := fields.ParseSelector(r.FieldSelector); err != nil {
+		return fmt.Errorf("invalid field selector: %w", err)
+	}
+	return nil
+}
+
+// watchNamespaces ... the namespaces to list and watch, metav1.NamespaceAll if there is no allow list
+func (r ReflectorConfig) watchNamespaces() []string {
+	if len(r.Namespaces) == 0 {
+		return []string{metav1.NamespaceAll}
+	}
+	out := []string{}
+	for _, ns := range r.Namespaces {
+		if ns != "" && !slices.Contains(r.ExcludedNamespaces, ns) && !slices.Contains(out, ns) {
+			out = append(out, ns)
+		}
+	}
+	slices.Sort(out)
+	return out
+}
+
+// tweakListOptions ... apply the selectors of the configuration to the services, the endpoints or the endpoint slices
+func (r ReflectorConfig) tweakListOptions(opts *metav1.ListOptions) {
+	r.tweakLookupListOptions(opts, true)
+	if r.FieldSelector != "" {
+		opts.FieldSelector = fields.AndSelectors(fields.ParseSelectorOrDie(r.FieldSelector), fields.ParseSelectorOrDie(opts.FieldSelector)).String()
+	}
+}
+
+// tweakLookupListOptions ...
+// apply the namespace deny list and optionally the label selector to the objects that are looked up while translating,
+// the field selector is not applied since it may refer to the fields that only the reflected objects have
+func (r ReflectorConfig) tweakLookupListOptions(opts *metav1.ListOptions, withLabelSelector bool) {
+	if withLabelSelector {
+		opts.LabelSelector = r.LabelSelector
+	}
+	selectors := make([]fields.Selector, 0, len(r.ExcludedNamespaces))
+	for _, ns := range r.ExcludedNamespaces {
+		selectors = append(selectors, fields.OneTermNotEqualSelector("metadata.namespace", ns))
+	}
+	opts.FieldSelector = fields.AndSelectors(selectors...).String()
+}
@@ -0,0 +1,80 @@
+package k8sreflector
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/sifer169966/go-xds/metrics"
+	"github.com/sifer169966/go-xds/snapshots"
+	otelmetric "go.opentelemetry.io/otel/metric"
+)
+
+// coalescedPushesHistogram ... the number of pushes that each snapshot update has coalesced
+var coalescedPushesHistogram, _ = metrics.GetGlobalMeter().Int64Histogram("xds_reflector_coalesced_pushes",
+	otelmetric.WithExplicitBucketBoundaries(1, 2, 5, 10, 20, 50, 100, 200, 500))
+
+// debouncedSetter ...
+// coalesces the bursts of pushes of a reflector into one snapshot update of the latest resources.
+// the update is delayed until there has been no push for the window, but not longer than the maxDelay since the first pending push
+type debouncedSetter struct {
+	snap     snapshots.SnapshotSetter
+	name     string
+	window   time.Duration
+	maxDelay time.Duration
+	// mu guards the pending push
+	mu        sync.Mutex
+	timer     *time.Timer
+	first     time.Time
+	pending   int
+	ctx       context.Context
+	version   string
+	resources []types.Resource
+	// setMu serializes the snapshot updates
+	setMu sync.Mutex
+}
+
+// newDebouncedSetter ... wrap the snapshot setter of a reflector, the pushes are passed through if the window is zero
+func newDebouncedSetter(s snapshots.SnapshotSetter, name string, cfg ReflectorConfig) snapshots.SnapshotSetter {
+	if cfg.DebounceWindow <= 0 {
+		return s
+	}
+	return &debouncedSetter{
+		snap:     s,
+		name:     name,
+		window:   cfg.DebounceWindow,
+		maxDelay: max(cfg.DebounceMaxDelay, cfg.DebounceWindow),
+	}
+}
+
+// Set ... keep the latest resources and schedule the snapshot update
+func (d *debouncedSetter) Set(ctx context.Context, version string, src []types.Resource) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.ctx, d.version, d.resources = ctx, version, src
+	d.pending++
+	if d.pending == 1 {
+		d.first = time.Now()
+		d.timer = time.AfterFunc(d.window, d.flush)
+		return
+	}
+	d.timer.Reset(min(d.window, d.maxDelay-time.Since(d.first)))
+}
+
+// flush ... set the latest resources into the snapshot
+func (d *debouncedSetter) flush() {
+	d.setMu.Lock()
+	defer d.setMu.Unlock()
+	d.mu.Lock()
+	if d.pending == 0 {
+		d.mu.Unlock()
+		return
+	}
+	ctx, version, resources, pending := d.ctx, d.version, d.resources, d.pending
+	d.pending = 0
+	d.resources = nil
+	d.mu.Unlock()
+	coalescedPushesHistogram.Record(context.Background(), int64(pending), otelmetric.WithAttributes(metrics.ResourceKindAttrKey.String(d.name)))
+	d.snap.Set(ctx, version, resources)
+}
@@ -2,14 +2,10 @@ package k8sreflector
 
 import (
 	"context"
-	"fmt"
-	"sort"
 
 	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
-	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
 	"github.com/sifer169966/go-xds/snapshots"
-	"google.golang.org/protobuf/types/known/wrapperspb"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -20,126 +16,135 @@ import (
 )
 
 type EndpointReflector struct {
-	api        kubernetes.Interface
+	api kubernetes.Interface
+	// serviceAPI is the k8s API of the services of the endpoints, it is the api unless they are resolved from another cluster
+	serviceAPI kubernetes.Interface
 	snap       snapshots.SnapshotSetter
-	refl       *k8scache.Reflector
-	localCache localCache
+	refl       *incrementalReflector
+	lookup     lookup
 	cfg        ReflectorConfig
 }
 
 // NewEndpointReflector ... create a new instance of *EndpointReflector
 func NewEndpointReflector(c kubernetes.Interface, s snapshots.SnapshotSetter, cfg ReflectorConfig) *EndpointReflector {
+	cfg = cfg.defaultConfigure()
+	// the legacy endpoints have no terminating condition, the addresses of the terminating pods are only drained by watching the pods
+	cfg.WatchPods = true
 	return &EndpointReflector{
-		api:  c,
-		snap: s,
-		cfg:  cfg.defaultConfigure(),
+		api:        c,
+		serviceAPI: c,
+		snap:       newDebouncedSetter(s, "endpoints", cfg),
+		cfg:        cfg,
 	}
 }
 
+// WithServicesFrom ...
+// resolve the services of the endpoints from the k8s API of another cluster, e.g. the local cluster that the services
+// of the endpoints of a remote cluster are translated from
+func (r *EndpointReflector) WithServicesFrom(c kubernetes.Interface) *EndpointReflector {
+	r.serviceAPI = c
+	return r
+}
+
 // Watch ... run the reflector to watching against k8s API to get the information about endpoint resources
 func (r *EndpointReflector) Watch(ctx context.Context) error {
-	store := k8scache.NewUndeltaStore(r.endpointsPushFunc(ctx), k8scache.DeletionHandlingMetaNamespaceKeyFunc)
-	r.refl = k8scache.NewReflector(&k8scache.ListWatch{
-		ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
-			return r.api.CoreV1().Endpoints("").List(ctx, opts)
-		},
-		WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
-			return r.api.CoreV1().Endpoints("").Watch(ctx, opts)
-		},
-	}, &corev1.Endpoints{}, store, r.cfg.ResyncPeriod)
+	r.lookup = newLookup(ctx, r.api, r.serviceAPI, r.cfg, func() {
+		r.refl.repush()
+	}, func(oldObj, newObj interface{}) {
+		r.refl.update(r.refl.podKeys(oldObj, newObj))
+	})
+	r.refl = newIncrementalReflector(r.cfg.watchNamespaces(), func(namespace string) k8scache.ListerWatcher {
+		return reportListWatchErrors(ctx, &k8scache.ListWatch{
+			ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+				r.cfg.tweakListOptions(&opts)
+				return r.api.CoreV1().Endpoints(namespace).List(ctx, opts)
+			},
+			WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+				r.cfg.tweakListOptions(&opts)
+				return r.api.CoreV1().Endpoints(namespace).Watch(ctx, opts)
+			},
+		})
+	}, &corev1.Endpoints{}, r.cfg.ResyncPeriod, k8scache.Indexers{podIndex: podIndexFunc}, metaNamespaceKeys, r.translate, newContentVersions(r.cfg), func(version string, resources []types.Resource) {
+		r.snap.Set(ctx, version, resources)
+	})
+	err := r.lookup.run(ctx, r.cfg.SyncTimeout)
+	if err != nil || ctx.Err() != nil {
+		return err
+	}
 	klog.Info("starting endpoints reflector")
-	r.refl.Run(ctx.Done())
+	err = r.refl.run(ctx, r.cfg.SyncTimeout)
+	if err != nil {
+		return err
+	}
 	klog.Warning("endpoints reflector has been stopped")
 	return nil
 }
 
-func (r *EndpointReflector) endpointsPushFunc(ctx context.Context) func(v []interface{}) {
-	return func(v []interface{}) {
-		latestVersion := r.refl.LastSyncResourceVersion()
-		endpoints := sliceToEndpoints(v)
-		resources := endpointsToResources(endpoints)
-		resourcesHashed, err := resourceHash(resources)
-		if err == nil {
-			r.localCache.lastResourceHashMutex.Lock()
-			defer r.localCache.lastResourceHashMutex.Unlock()
-			if resourcesHashed == r.localCache.lastResourcesHash {
-				klog.Info("endpoint resources hashed equal with the previous one, no need to update")
-				return
-			}
-			r.localCache.lastResourcesHash = resourcesHashed
-		} else {
-			klog.Error("endpoint resource hash failed", "err", err)
-		}
-		r.snap.Set(ctx, latestVersion, resources)
+// translate ... translate an endpoints by its namespace/name key
+func (r *EndpointReflector) translate(key string, reports *annotationReports) []types.Resource {
+	obj, ok := r.refl.objects.get(key)
+	if !ok {
+		return nil
 	}
+	return endpointsToResources([]*corev1.Endpoints{obj.(*corev1.Endpoints)}, r.lookup.reporting(reports), r.cfg)
 }
 
 // endpointsToResources ...
-// creating eds resources from k8s endpoints
-func endpointsToResources(eps []*corev1.Endpoints) []types.Resource {
+// creating eds resources from k8s endpoints, the locality of each address is resolved from its node.
+// the not ready addresses are published as UNHEALTHY and the addresses of terminating pods as DRAINING
+// if the service opts in by the AnnotationPublishUnreadyEndpoints. the endpoints of the services that are not exported are skipped.
+// the weight of each address is read from its pod. each pod of a headless service also gets its own eds resource
+func endpointsToResources(eps []*corev1.Endpoints, l lookup, cfg ReflectorConfig) []types.Resource {
 	var out []types.Resource
 	for _, ep := range eps {
+		svc := l.service(ep.Namespace, ep.Name)
+		annotations := l.serviceAnnotations(ep.Namespace, ep.Name)
+		if !annotations.isExported(cfg.RequireOptIn) {
+			continue
+		}
+		publishUnready := annotations.bool(AnnotationPublishUnreadyEndpoints, false)
 		for _, subset := range ep.Subsets {
 			for _, port := range subset.Ports {
-				var clusterName string
-				if port.Name == "" {
-					clusterName = fmt.Sprintf("%s.%s:%d", ep.Name, ep.Namespace, port.Port)
-				} else {
-					clusterName = fmt.Sprintf("%s.%s:%s", ep.Name, ep.Namespace, port.Name)
-				}
-				cla := &endpointv3.ClusterLoadAssignment{
-					ClusterName: clusterName,
-					Endpoints: []*endpointv3.LocalityLbEndpoints{
-						{
-							LoadBalancingWeight: wrapperspb.UInt32(1),
-							Locality:            &corev3.Locality{},
-							LbEndpoints:         []*endpointv3.LbEndpoint{},
-						},
-					},
+				svcPort, ok := servicePort(svc, port.Name)
+				if !ok {
+					continue
 				}
-				sort.SliceStable(subset.Addresses, func(i, j int) bool {
-					left := subset.Addresses[i].IP
-					right := subset.Addresses[j].IP
-					return left < right
-				})
+				clusterName := cfg.clusterName(ep.Namespace, ep.Name, svcPort)
+				addrs := make([]endpointAddress, 0, len(subset.Addresses)+len(subset.NotReadyAddresses))
 				for _, addr := range subset.Addresses {
-					hostname := addr.Hostname
-					if hostname == "" && addr.TargetRef != nil {
-						hostname = fmt.Sprintf("%s.%s", addr.TargetRef.Name, addr.TargetRef.Namespace)
+					health := corev3.HealthStatus_HEALTHY
+					if publishUnready && isPodTerminating(l.pod(addr.TargetRef)) {
+						health = corev3.HealthStatus_DRAINING
 					}
-					if hostname == "" && addr.NodeName != nil {
-						hostname = *addr.NodeName
+					addrs = append(addrs, newEndpointAddress(addr, port, health, l, cfg))
+				}
+				if publishUnready {
+					for _, addr := range subset.NotReadyAddresses {
+						health := corev3.HealthStatus_UNHEALTHY
+						if isPodTerminating(l.pod(addr.TargetRef)) {
+							health = corev3.HealthStatus_DRAINING
+						}
+						addrs = append(addrs, newEndpointAddress(addr, port, health, l, cfg))
 					}
-					cla.Endpoints[0].LbEndpoints = append(cla.Endpoints[0].LbEndpoints, &endpointv3.LbEndpoint{
-						HostIdentifier: &endpointv3.LbEndpoint_Endpoint{
-							Endpoint: &endpointv3.Endpoint{
-								Address: &corev3.Address{
-									Address: &corev3.Address_SocketAddress{
-										SocketAddress: &corev3.SocketAddress{
-											Protocol: corev3.SocketAddress_TCP,
-											Address:  addr.IP,
-											PortSpecifier: &corev3.SocketAddress_PortValue{
-												PortValue: uint32(port.Port),
-											},
-										},
-									},
-								},
-								Hostname: hostname,
-							},
-						},
-					})
 				}
-				out = append(out, cla)
+				if svc != nil && isHeadless(svc) {
+					out = append(out, newHeadlessLoadAssignments(clusterName, addrs)...)
+				}
+				out = append(out, newClusterLoadAssignment(clusterName, addrs))
 			}
 		}
 	}
 	return out
 }
 
-func sliceToEndpoints(endpoints []interface{}) []*corev1.Endpoints {
-	out := make([]*corev1.Endpoints, len(endpoints))
-	for i, ep := range endpoints {
-		out[i] = ep.(*corev1.Endpoints)
+func newEndpointAddress(addr corev1.EndpointAddress, port corev1.EndpointPort, health corev3.HealthStatus, l lookup, cfg ReflectorConfig) endpointAddress {
+	return endpointAddress{
+		ip:       addr.IP,
+		port:     uint32(port.Port),
+		hostname: addressHostname(addr.Hostname, addr.TargetRef, addr.NodeName),
+		health:   health,
+		locality: l.locality(addr.NodeName),
+		weight:   podWeight(l.pod(addr.TargetRef), l, cfg.WeightFromCPURequests),
+		podName:  headlessPodName(addr.Hostname, addr.TargetRef),
 	}
-	return out
 }
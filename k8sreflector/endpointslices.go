@@ -0,0 +1,198 @@
+package k8sreflector
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/sifer169966/go-xds/snapshots"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	k8scache "k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+type EndpointSliceReflector struct {
+	api kubernetes.Interface
+	// serviceAPI is the k8s API of the services of the endpoints, it is the api unless they are resolved from another cluster
+	serviceAPI kubernetes.Interface
+	snap       snapshots.SnapshotSetter
+	refl       *incrementalReflector
+	lookup     lookup
+	cfg        ReflectorConfig
+}
+
+// NewEndpointSliceReflector ... create a new instance of *EndpointSliceReflector
+func NewEndpointSliceReflector(c kubernetes.Interface, s snapshots.SnapshotSetter, cfg ReflectorConfig) *EndpointSliceReflector {
+	cfg = cfg.defaultConfigure()
+	return &EndpointSliceReflector{
+		api:        c,
+		serviceAPI: c,
+		snap:       newDebouncedSetter(s, "endpointslices", cfg),
+		cfg:        cfg,
+	}
+}
+
+// WithServicesFrom ...
+// resolve the services of the endpoints from the k8s API of another cluster, e.g. the local cluster that the services
+// of the endpoints of a remote cluster are translated from
+func (r *EndpointSliceReflector) WithServicesFrom(c kubernetes.Interface) *EndpointSliceReflector {
+	r.serviceAPI = c
+	return r
+}
+
+// Watch ... run the reflector to watching against k8s API to get the information about endpoint slice resources
+func (r *EndpointSliceReflector) Watch(ctx context.Context) error {
+	r.lookup = newLookup(ctx, r.api, r.serviceAPI, r.cfg, func() {
+		r.refl.repush()
+	}, func(oldObj, newObj interface{}) {
+		r.refl.update(r.refl.podKeys(oldObj, newObj))
+	})
+	r.refl = newIncrementalReflector(r.cfg.watchNamespaces(), func(namespace string) k8scache.ListerWatcher {
+		return reportListWatchErrors(ctx, &k8scache.ListWatch{
+			ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+				r.cfg.tweakListOptions(&opts)
+				return r.api.DiscoveryV1().EndpointSlices(namespace).List(ctx, opts)
+			},
+			WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+				r.cfg.tweakListOptions(&opts)
+				return r.api.DiscoveryV1().EndpointSlices(namespace).Watch(ctx, opts)
+			},
+		})
+	}, &discoveryv1.EndpointSlice{}, r.cfg.ResyncPeriod, k8scache.Indexers{serviceIndex: serviceIndexFunc, podIndex: podIndexFunc}, endpointSliceServiceKeys, r.translate, newContentVersions(r.cfg), func(version string, resources []types.Resource) {
+		r.snap.Set(ctx, version, resources)
+	})
+	err := r.lookup.run(ctx, r.cfg.SyncTimeout)
+	if err != nil || ctx.Err() != nil {
+		return err
+	}
+	klog.Info("starting endpoint slices reflector")
+	err = r.refl.run(ctx, r.cfg.SyncTimeout)
+	if err != nil {
+		return err
+	}
+	klog.Warning("endpoint slices reflector has been stopped")
+	return nil
+}
+
+// translate ... translate every endpoint slice of a service by the namespace/name key of the service
+func (r *EndpointSliceReflector) translate(key string, reports *annotationReports) []types.Resource {
+	var epss []*discoveryv1.EndpointSlice
+	for _, obj := range r.refl.objects.byIndex(serviceIndex, key) {
+		epss = append(epss, obj.(*discoveryv1.EndpointSlice))
+	}
+	return endpointSlicesToResources(epss, r.lookup.reporting(reports), r.cfg)
+}
+
+// endpointSliceServiceKeys ... the endpoint slices are translated together by the namespace/name key of their service
+func endpointSliceServiceKeys(obj interface{}) []string {
+	keys, _ := serviceIndexFunc(obj)
+	return keys
+}
+
+// endpointSlicesToResources ...
+// creating eds resources from k8s endpoint slices, all slices that belong to the same service are merged into
+// the same cluster load assignment as endpointsToResources would produce from the legacy endpoints of that service.
+// the locality of each endpoint is resolved from its node, the zone of the endpoint is used when the node has no zone.
+// the weight of each endpoint is read from its pod.
+// only the ready endpoints are published unless the service opts in by the AnnotationPublishUnreadyEndpoints
+// and the endpoints of the services that are not exported are skipped. each pod of a headless service also gets its own eds resource
+func endpointSlicesToResources(epss []*discoveryv1.EndpointSlice, l lookup, cfg ReflectorConfig) []types.Resource {
+	// sort the slices by name to make the address deduplication below deterministic
+	slices.SortStableFunc(epss, func(a, b *discoveryv1.EndpointSlice) int {
+		return cmp.Or(cmp.Compare(a.Namespace, b.Namespace), cmp.Compare(a.Name, b.Name))
+	})
+	var clusterNames []string
+	clusters := map[string][]endpointAddress{}
+	headless := map[string]bool{}
+	seen := map[string]struct{}{}
+	for _, eps := range epss {
+		serviceName := eps.Labels[discoveryv1.LabelServiceName]
+		if serviceName == "" || eps.AddressType == discoveryv1.AddressTypeFQDN {
+			continue
+		}
+		svc := l.service(eps.Namespace, serviceName)
+		annotations := l.serviceAnnotations(eps.Namespace, serviceName)
+		if !annotations.isExported(cfg.RequireOptIn) {
+			continue
+		}
+		publishUnready := annotations.bool(AnnotationPublishUnreadyEndpoints, false)
+		for _, port := range eps.Ports {
+			if port.Port == nil {
+				continue
+			}
+			var portName string
+			if port.Name != nil {
+				portName = *port.Name
+			}
+			svcPort, ok := servicePort(svc, portName)
+			if !ok {
+				continue
+			}
+			clusterName := cfg.clusterName(eps.Namespace, serviceName, svcPort)
+			if _, ok := clusters[clusterName]; !ok {
+				clusterNames = append(clusterNames, clusterName)
+				clusters[clusterName] = []endpointAddress{}
+				headless[clusterName] = svc != nil && isHeadless(svc)
+			}
+			for _, ep := range eps.Endpoints {
+				health := endpointConditionsToHealthStatus(ep.Conditions)
+				if len(ep.Addresses) == 0 || (!publishUnready && health != corev3.HealthStatus_HEALTHY) {
+					continue
+				}
+				// an endpoint may be mirrored into more than one slice while it is being moved between them
+				key := fmt.Sprintf("%s/%s/%d", clusterName, ep.Addresses[0], *port.Port)
+				if _, ok := seen[key]; ok {
+					continue
+				}
+				seen[key] = struct{}{}
+				var hostname string
+				if ep.Hostname != nil {
+					hostname = *ep.Hostname
+				}
+				loc := l.locality(ep.NodeName)
+				if loc.zone == "" && ep.Zone != nil {
+					loc.zone = *ep.Zone
+				}
+				clusters[clusterName] = append(clusters[clusterName], endpointAddress{
+					ip:       ep.Addresses[0],
+					port:     uint32(*port.Port),
+					hostname: addressHostname(hostname, ep.TargetRef, ep.NodeName),
+					health:   health,
+					locality: loc,
+					weight:   podWeight(l.pod(ep.TargetRef), l, cfg.WeightFromCPURequests),
+					podName:  headlessPodName(hostname, ep.TargetRef),
+				})
+			}
+		}
+	}
+	out := make([]types.Resource, 0, len(clusterNames))
+	for _, clusterName := range clusterNames {
+		if headless[clusterName] {
+			out = append(out, newHeadlessLoadAssignments(clusterName, clusters[clusterName])...)
+		}
+		out = append(out, newClusterLoadAssignment(clusterName, clusters[clusterName]))
+	}
+	return out
+}
+
+// endpointConditionsToHealthStatus ...
+// map the conditions of an endpoint slice endpoint onto the envoy health status
+//   - ready, or unknown readiness, is HEALTHY
+//   - terminating but still serving is DRAINING to let the clients finish the in-flight requests
+//   - anything else is UNHEALTHY
+func endpointConditionsToHealthStatus(cond discoveryv1.EndpointConditions) corev3.HealthStatus {
+	if cond.Ready == nil || *cond.Ready {
+		return corev3.HealthStatus_HEALTHY
+	}
+	if cond.Terminating != nil && *cond.Terminating && cond.Serving != nil && *cond.Serving {
+		return corev3.HealthStatus_DRAINING
+	}
+	return corev3.HealthStatus_UNHEALTHY
+}
@@ -0,0 +1,474 @@
+package k8sreflector
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	matcherv3 "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/sifer169966/go-xds/metrics"
+	"github.com/sifer169966/go-xds/snapshots"
+	otelmetric "go.opentelemetry.io/otel/metric"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	k8scache "k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
+	gatewayclient "sigs.k8s.io/gateway-api/pkg/client/clientset/versioned"
+)
+
+const (
+	kindHTTPRoute = "HTTPRoute"
+	kindGRPCRoute = "GRPCRoute"
+)
+
+// invalidGatewayRouteCounter ... count the rules of the gateway routes that could not be translated as they are
+var invalidGatewayRouteCounter, _ = metrics.GetGlobalMeter().Int64Counter("xds_reflector_invalid_gateway_route_rules")
+
+// GatewayRouteReflector ...
+// reflects the Gateway API HTTPRoutes and GRPCRoutes that are attached to the services into rds resources.
+// the routes replace the default route of the ports of the services, so the lds and rds resources have to be set
+// by a snapshots.Snapshot.Source of a higher priority than the one of the ServiceReflector
+type GatewayRouteReflector struct {
+	api        kubernetes.Interface
+	gatewayAPI gatewayclient.Interface
+	snap       snapshots.SnapshotSetter
+	httpRoutes *namespacedReflector
+	grpcRoutes *namespacedReflector
+	lookup     lookup
+	localCache localCache
+	versions   *contentVersions
+	cfg        ReflectorConfig
+	// mu guards the objects of both kinds of routes, they are nil until they have been listed, and the reports
+	mu            sync.Mutex
+	httpRouteObjs []interface{}
+	grpcRouteObjs []interface{}
+	// reports is the invalid annotations of the services that the last translation of the routes has reported
+	reports *annotationReports
+}
+
+// NewGatewayRouteReflector ... create a new instance of *GatewayRouteReflector
+func NewGatewayRouteReflector(c kubernetes.Interface, gc gatewayclient.Interface, s snapshots.SnapshotSetter, cfg ReflectorConfig) *GatewayRouteReflector {
+	cfg = cfg.defaultConfigure()
+	return &GatewayRouteReflector{
+		api:        c,
+		gatewayAPI: gc,
+		snap:       newDebouncedSetter(s, "gateway-routes", cfg),
+		versions:   newContentVersions(cfg),
+		cfg:        cfg,
+	}
+}
+
+// Watch ... run the reflector to watching against k8s API to get the information about HTTPRoute and GRPCRoute resources
+func (r *GatewayRouteReflector) Watch(ctx context.Context) error {
+	r.lookup = lookup{
+		services: newServiceCache(ctx, r.api, r.cfg, r.repush),
+	}
+	namespaces := r.cfg.watchNamespaces()
+	r.httpRoutes = newNamespacedReflector(namespaces, func(namespace string) k8scache.ListerWatcher {
+		return reportListWatchErrors(ctx, &k8scache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				r.cfg.tweakLookupListOptions(&options, false)
+				return r.gatewayAPI.GatewayV1().HTTPRoutes(namespace).List(ctx, options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				r.cfg.tweakLookupListOptions(&options, false)
+				return r.gatewayAPI.GatewayV1().HTTPRoutes(namespace).Watch(ctx, options)
+			},
+		})
+	}, &gatewayv1.HTTPRoute{}, r.cfg.ResyncPeriod, r.routesPushFunc(ctx, kindHTTPRoute))
+	r.grpcRoutes = newNamespacedReflector(namespaces, func(namespace string) k8scache.ListerWatcher {
+		return reportListWatchErrors(ctx, &k8scache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				r.cfg.tweakLookupListOptions(&options, false)
+				return r.gatewayAPI.GatewayV1().GRPCRoutes(namespace).List(ctx, options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				r.cfg.tweakLookupListOptions(&options, false)
+				return r.gatewayAPI.GatewayV1().GRPCRoutes(namespace).Watch(ctx, options)
+			},
+		})
+	}, &gatewayv1.GRPCRoute{}, r.cfg.ResyncPeriod, r.routesPushFunc(ctx, kindGRPCRoute))
+	err := r.lookup.run(ctx, r.cfg.SyncTimeout)
+	if err != nil || ctx.Err() != nil {
+		return err
+	}
+	klog.Info("starting gateway routes reflector")
+	wg := sync.WaitGroup{}
+	for _, refl := range []*namespacedReflector{r.httpRoutes, r.grpcRoutes} {
+		wg.Add(1)
+		go func(refl *namespacedReflector) {
+			defer wg.Done()
+			refl.run(ctx)
+		}(refl)
+	}
+	wg.Wait()
+	klog.Warning("gateway routes reflector has been stopped")
+	return nil
+}
+
+// repush ... translate the routes again when the services have been changed
+func (r *GatewayRouteReflector) repush() {
+	// the push of either kind translates both of them
+	r.httpRoutes.repush()
+}
+
+func (r *GatewayRouteReflector) routesPushFunc(ctx context.Context, kind string) func(v []interface{}) {
+	return func(v []interface{}) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if v == nil {
+			v = []interface{}{}
+		}
+		switch kind {
+		case kindHTTPRoute:
+			r.httpRouteObjs = v
+		case kindGRPCRoute:
+			r.grpcRouteObjs = v
+		}
+		// nothing is pushed until both kinds of routes have been listed to not drop the routes of the other kind
+		if r.httpRouteObjs == nil || r.grpcRouteObjs == nil {
+			return
+		}
+		r.reports = r.reports.next()
+		resources := gatewayRoutesToResources(sliceToHTTPRoutes(r.httpRouteObjs), sliceToGRPCRoutes(r.grpcRouteObjs), r.lookup.reporting(r.reports), r.cfg)
+		resourcesHashed, err := resourceHash(resources)
+		if err != nil {
+			// the version is derived from the hash, and the resources that could not be marshaled could not be served either
+			klog.Error("gateway route resource hash failed", "err", err)
+			return
+		}
+		r.localCache.lastResourceHashMutex.Lock()
+		defer r.localCache.lastResourceHashMutex.Unlock()
+		if resourcesHashed == r.localCache.lastResourcesHash {
+			klog.Info("gateway route resources hashed equal with the previous one, no need to update")
+			return
+		}
+		r.localCache.lastResourcesHash = resourcesHashed
+		r.snap.Set(ctx, r.versions.version(resourcesHashed), resources)
+	}
+}
+
+// gatewayRouteObject ... the metadata of an HTTPRoute or a GRPCRoute that is needed to translate its rules
+type gatewayRouteObject struct {
+	kind       string
+	namespace  string
+	name       string
+	created    metav1.Time
+	parentRefs []gatewayv1.ParentReference
+}
+
+// key ... the kind/namespace/name of the route to name the translated routes and to report the invalid ones
+func (o gatewayRouteObject) key() string {
+	return o.kind + "/" + o.namespace + "/" + o.name
+}
+
+// invalid ... report the rule of the route that could not be translated as it is in the logs and the metrics
+func (o gatewayRouteObject) invalid(rule int, err error) {
+	klog.Error("invalid gateway route rule, the requests that it matches are rejected", "route", o.key(), "rule", rule, "err", err)
+	invalidGatewayRouteCounter.Add(context.Background(), 1, otelmetric.WithAttributes(metrics.ResourceKindAttrKey.String(o.kind)))
+}
+
+// parentPort ... a port of a service that gateway routes are attached to
+type parentPort struct {
+	namespace string
+	service   string
+	port      int32
+}
+
+// gatewayRouteEntry ... a translated route of a rule of a gateway route
+type gatewayRouteEntry struct {
+	object     gatewayRouteObject
+	precedence routePrecedence
+	route      *routev3.Route
+}
+
+// routePrecedence ... the attributes of the matches that the gateway API orders the routes by
+type routePrecedence struct {
+	exactPath   bool
+	pathLength  int
+	method      bool
+	headers     int
+	queryParams int
+}
+
+// compare ... order the more specific matches first
+func (p routePrecedence) compare(other routePrecedence) int {
+	if p.exactPath != other.exactPath {
+		if p.exactPath {
+			return -1
+		}
+		return 1
+	}
+	if p.pathLength != other.pathLength {
+		return cmp.Compare(other.pathLength, p.pathLength)
+	}
+	if p.method != other.method {
+		if p.method {
+			return -1
+		}
+		return 1
+	}
+	if p.headers != other.headers {
+		return cmp.Compare(other.headers, p.headers)
+	}
+	return cmp.Compare(other.queryParams, p.queryParams)
+}
+
+// gatewayRoutesToResources ...
+// creating the lds and rds resources of the service ports that the HTTPRoutes and the GRPCRoutes are attached to.
+// only the producer routes are supported, i.e. the parent services must be in the namespaces of the routes.
+// the routes of a service port are ordered by the precedence of their matches, then the older routes come first.
+// the route policy of the annotations of a service is the default of the routes that are attached to it.
+// the requests that none of the routes matches are rejected as the gateway API defines
+func gatewayRoutesToResources(httpRoutes []*gatewayv1.HTTPRoute, grpcRoutes []*gatewayv1.GRPCRoute, l lookup, cfg ReflectorConfig) []types.Resource {
+	entries := map[parentPort][]gatewayRouteEntry{}
+	policies := map[string]routePolicy{}
+	attach := func(object gatewayRouteObject, translate func(policy routePolicy) []gatewayRouteEntry) {
+		for _, parent := range gatewayParentPorts(object, l, cfg) {
+			key := parent.namespace + "/" + parent.service
+			policy, ok := policies[key]
+			if !ok {
+				policy = newRoutePolicy(l.serviceAnnotations(parent.namespace, parent.service))
+				policies[key] = policy
+			}
+			entries[parent] = append(entries[parent], translate(policy)...)
+		}
+	}
+	for _, route := range httpRoutes {
+		object := gatewayRouteObject{
+			kind:       kindHTTPRoute,
+			namespace:  route.Namespace,
+			name:       route.Name,
+			created:    route.CreationTimestamp,
+			parentRefs: route.Spec.ParentRefs,
+		}
+		attach(object, func(policy routePolicy) []gatewayRouteEntry {
+			return httpRouteToRoutes(object, route.Spec.Rules, policy, l, cfg)
+		})
+	}
+	for _, route := range grpcRoutes {
+		object := gatewayRouteObject{
+			kind:       kindGRPCRoute,
+			namespace:  route.Namespace,
+			name:       route.Name,
+			created:    route.CreationTimestamp,
+			parentRefs: route.Spec.ParentRefs,
+		}
+		attach(object, func(policy routePolicy) []gatewayRouteEntry {
+			return grpcRouteToRoutes(object, route.Spec.Rules, policy, l, cfg)
+		})
+	}
+
+	parents := make([]parentPort, 0, len(entries))
+	for parent := range entries {
+		parents = append(parents, parent)
+	}
+	slices.SortFunc(parents, func(a, b parentPort) int {
+		return cmp.Or(cmp.Compare(a.namespace, b.namespace), cmp.Compare(a.service, b.service), cmp.Compare(a.port, b.port))
+	})
+	out := []types.Resource{}
+	for _, parent := range parents {
+		svc := l.service(parent.namespace, parent.service)
+		port, ok := serviceNumberPort(svc, parent.port)
+		if !ok {
+			continue
+		}
+		routeEntries := entries[parent]
+		slices.SortStableFunc(routeEntries, func(a, b gatewayRouteEntry) int {
+			return cmp.Or(
+				a.precedence.compare(b.precedence),
+				a.object.created.Compare(b.object.created.Time),
+				cmp.Compare(a.object.namespace+"/"+a.object.name, b.object.namespace+"/"+b.object.name),
+			)
+		})
+		routes := make([]*routev3.Route, len(routeEntries))
+		for i, entry := range routeEntries {
+			routes[i] = entry.route
+		}
+		host := fmt.Sprintf("%s.%s", svc.Name, svc.Namespace)
+		out = append(out, newVirtualHostResources(svc.Namespace, host, port, []string{svc.Name}, routes)...)
+	}
+	return out
+}
+
+// gatewayParentPorts ...
+// resolve the service ports that a route is attached to, the parents that are not services are skipped.
+// a parent without a port or a section name is attached to every port of the service
+func gatewayParentPorts(object gatewayRouteObject, l lookup, cfg ReflectorConfig) []parentPort {
+	var out []parentPort
+	for _, ref := range object.parentRefs {
+		if !isCoreGroup(ref.Group) || ref.Kind == nil || *ref.Kind != "Service" {
+			continue
+		}
+		if ref.Namespace != nil && string(*ref.Namespace) != object.namespace {
+			klog.Warning("gateway route is attached to a service of another namespace, the parent is skipped", "route", object.key(), "parent", ref.Name)
+			continue
+		}
+		svc := l.service(object.namespace, string(ref.Name))
+		if svc == nil || !l.annotations(svc).isExported(cfg.RequireOptIn) {
+			continue
+		}
+		for _, port := range svc.Spec.Ports {
+			if ref.Port != nil && int32(*ref.Port) != port.Port {
+				continue
+			}
+			if ref.SectionName != nil && string(*ref.SectionName) != port.Name {
+				continue
+			}
+			parent := parentPort{namespace: svc.Namespace, service: svc.Name, port: port.Port}
+			if !slices.Contains(out, parent) {
+				out = append(out, parent)
+			}
+		}
+	}
+	return out
+}
+
+// gatewayBackend ... a backend of a rule that has been resolved into its cluster
+type gatewayBackend struct {
+	clusterName string
+	weight      uint32
+	headers     headerMutation
+}
+
+// resolveBackendRef ... resolve the cluster of a backend service port in the namespace of the route
+func resolveBackendRef(ref gatewayv1.BackendObjectReference, namespace string, l lookup, cfg ReflectorConfig) (string, error) {
+	if !isCoreGroup(ref.Group) || (ref.Kind != nil && *ref.Kind != "Service") {
+		return "", fmt.Errorf("backend %s is not a service", ref.Name)
+	}
+	if ref.Namespace != nil && string(*ref.Namespace) != namespace {
+		return "", fmt.Errorf("backend %s is not in the namespace of the route", ref.Name)
+	}
+	if ref.Port == nil {
+		return "", fmt.Errorf("backend %s has no port", ref.Name)
+	}
+	svc := l.service(namespace, string(ref.Name))
+	if svc == nil || !l.annotations(svc).isExported(cfg.RequireOptIn) {
+		return "", fmt.Errorf("backend %s is not found", ref.Name)
+	}
+	port, ok := serviceNumberPort(svc, int32(*ref.Port))
+	if !ok {
+		return "", fmt.Errorf("backend %s has no port %d", ref.Name, *ref.Port)
+	}
+	return cfg.clusterName(svc.Namespace, svc.Name, port), nil
+}
+
+// newBackendsAction ...
+// creating the route action that splits the requests between the backends by their weights,
+// the backends of which weights are zero receive no requests
+func newBackendsAction(backends []gatewayBackend) (*routev3.RouteAction, error) {
+	backends = slices.DeleteFunc(slices.Clone(backends), func(b gatewayBackend) bool {
+		return b.weight == 0
+	})
+	if len(backends) == 0 {
+		return nil, errors.New("no backend to route the requests to")
+	}
+	if len(backends) == 1 && backends[0].headers.empty() {
+		return &routev3.RouteAction{
+			ClusterSpecifier: &routev3.RouteAction_Cluster{
+				Cluster: backends[0].clusterName,
+			},
+		}, nil
+	}
+	weighted := &routev3.WeightedCluster{}
+	for _, backend := range backends {
+		cluster := &routev3.WeightedCluster_ClusterWeight{
+			Name:   backend.clusterName,
+			Weight: wrapperspb.UInt32(backend.weight),
+		}
+		backend.headers.applyToClusterWeight(cluster)
+		weighted.Clusters = append(weighted.Clusters, cluster)
+	}
+	return &routev3.RouteAction{
+		ClusterSpecifier: &routev3.RouteAction_WeightedClusters{
+			WeightedClusters: weighted,
+		},
+	}, nil
+}
+
+// backendWeight ... the weight of a backend, default to one
+func backendWeight(weight *int32) uint32 {
+	if weight == nil {
+		return 1
+	}
+	return uint32(max(*weight, 0))
+}
+
+// newHeaderMatcher ... match a header exactly by default, or by a regular expression
+func newHeaderMatcher(name string, matchType *gatewayv1.HeaderMatchType, value string) *routev3.HeaderMatcher {
+	return &routev3.HeaderMatcher{
+		Name: name,
+		HeaderMatchSpecifier: &routev3.HeaderMatcher_StringMatch{
+			StringMatch: newStringMatcher(matchType != nil && *matchType == gatewayv1.HeaderMatchRegularExpression, value),
+		},
+	}
+}
+
+// newStringMatcher ... match a string exactly or by a regular expression
+func newStringMatcher(regex bool, value string) *matcherv3.StringMatcher {
+	if regex {
+		return &matcherv3.StringMatcher{
+			MatchPattern: &matcherv3.StringMatcher_SafeRegex{
+				SafeRegex: &matcherv3.RegexMatcher{Regex: value},
+			},
+		}
+	}
+	return &matcherv3.StringMatcher{
+		MatchPattern: &matcherv3.StringMatcher_Exact{Exact: value},
+	}
+}
+
+// newRejectRoute ... creating the route that rejects the requests of an invalid rule as the gateway API defines
+func newRejectRoute(name string, match *routev3.RouteMatch) *routev3.Route {
+	return &routev3.Route{
+		Name:  name,
+		Match: match,
+		Action: &routev3.Route_DirectResponse{
+			DirectResponse: &routev3.DirectResponseAction{Status: 500},
+		},
+	}
+}
+
+// isCoreGroup ... report whether the group of a reference is the core API group
+func isCoreGroup(group *gatewayv1.Group) bool {
+	return group == nil || *group == "" || *group == "core"
+}
+
+// serviceNumberPort ... find the port of the service by its number
+func serviceNumberPort(svc *corev1.Service, number int32) (corev1.ServicePort, bool) {
+	if svc == nil {
+		return corev1.ServicePort{}, false
+	}
+	for _, port := range svc.Spec.Ports {
+		if port.Port == number {
+			return port, true
+		}
+	}
+	return corev1.ServicePort{}, false
+}
+
+func sliceToHTTPRoutes(routes []interface{}) []*gatewayv1.HTTPRoute {
+	out := make([]*gatewayv1.HTTPRoute, len(routes))
+	for i, route := range routes {
+		out[i] = route.(*gatewayv1.HTTPRoute)
+	}
+	return out
+}
+
+func sliceToGRPCRoutes(routes []interface{}) []*gatewayv1.GRPCRoute {
+	out := make([]*gatewayv1.GRPCRoute, len(routes))
+	for i, route := range routes {
+		out[i] = route.(*gatewayv1.GRPCRoute)
+	}
+	return out
+}
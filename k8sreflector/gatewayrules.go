@@ -0,0 +1,333 @@
+package k8sreflector
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	matcherv3 "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
+)
+
+// gatewayRuleSpec ... the parts of an HTTPRoute or a GRPCRoute rule that are shared by every match of it
+type gatewayRuleSpec struct {
+	filters  []gatewayv1.HTTPRouteFilter
+	backends []gatewayBackendSpec
+	timeouts *gatewayv1.HTTPRouteTimeouts
+}
+
+// gatewayBackendSpec ... a backendRef of a rule with its own filters
+type gatewayBackendSpec struct {
+	ref     gatewayv1.BackendRef
+	filters []gatewayv1.HTTPRouteFilter
+}
+
+// gatewayRule ... the translation of a rule, the requests that it matches are rejected if it is invalid
+type gatewayRule struct {
+	headers  headerMutation
+	action   *routev3.RouteAction
+	redirect *routev3.RedirectAction
+	err      error
+}
+
+// newGatewayRule ...
+// translate the filters and the backends of a rule, the backends that could not be resolved are skipped
+// while the unsupported filters invalidate the whole rule
+func newGatewayRule(object gatewayRouteObject, index int, spec gatewayRuleSpec, policy routePolicy, l lookup, cfg ReflectorConfig) gatewayRule {
+	out, err := newGatewayRuleAction(object, index, spec, policy, l, cfg)
+	if err != nil {
+		object.invalid(index, err)
+		return gatewayRule{err: err}
+	}
+	return out
+}
+
+func newGatewayRuleAction(object gatewayRouteObject, index int, spec gatewayRuleSpec, policy routePolicy, l lookup, cfg ReflectorConfig) (gatewayRule, error) {
+	filters, err := newGatewayFilters(spec.filters, object.namespace, l, cfg)
+	if err != nil {
+		return gatewayRule{}, err
+	}
+	if filters.redirect != nil {
+		redirect, err := newRedirectAction(filters.redirect)
+		return gatewayRule{headers: filters.headers, redirect: redirect}, err
+	}
+	var backends []gatewayBackend
+	for _, backend := range spec.backends {
+		backendFilters, err := newGatewayFilters(backend.filters, object.namespace, l, cfg)
+		if err == nil && (len(backendFilters.mirrors) > 0 || backendFilters.redirect != nil || backendFilters.rewrite != nil) {
+			err = errors.New("only the header modifier filters are supported by the backends")
+		}
+		if err != nil {
+			return gatewayRule{}, err
+		}
+		clusterName, err := resolveBackendRef(backend.ref.BackendObjectReference, object.namespace, l, cfg)
+		if err != nil {
+			object.invalid(index, err)
+			continue
+		}
+		backends = append(backends, gatewayBackend{
+			clusterName: clusterName,
+			weight:      backendWeight(backend.ref.Weight),
+			headers:     backendFilters.headers,
+		})
+	}
+	action, err := newBackendsAction(backends)
+	if err != nil {
+		return gatewayRule{}, err
+	}
+	policy.apply(action)
+	if err := applyRouteTimeouts(action, spec.timeouts); err != nil {
+		return gatewayRule{}, err
+	}
+	action.RequestMirrorPolicies = filters.mirrors
+	applyURLRewrite(action, filters.rewrite)
+	return gatewayRule{headers: filters.headers, action: action}, nil
+}
+
+// route ... creating the route of a match of the rule
+func (g gatewayRule) route(name string, match *routev3.RouteMatch) *routev3.Route {
+	if g.err != nil {
+		return newRejectRoute(name, match)
+	}
+	out := &routev3.Route{
+		Name:  name,
+		Match: match,
+	}
+	g.headers.applyToRoute(out)
+	if g.redirect != nil {
+		out.Action = &routev3.Route_Redirect{
+			Redirect: proto.Clone(g.redirect).(*routev3.RedirectAction),
+		}
+	} else {
+		out.Action = &routev3.Route_Route{
+			Route: proto.Clone(g.action).(*routev3.RouteAction),
+		}
+	}
+	return out
+}
+
+// gatewayFilters ... the translation of the filters of a rule or a backend
+type gatewayFilters struct {
+	headers  headerMutation
+	mirrors  []*routev3.RouteAction_RequestMirrorPolicy
+	redirect *gatewayv1.HTTPRequestRedirectFilter
+	rewrite  *gatewayv1.HTTPURLRewriteFilter
+}
+
+// newGatewayFilters ... translate the filters, the ExtensionRef filters are not supported
+func newGatewayFilters(filters []gatewayv1.HTTPRouteFilter, namespace string, l lookup, cfg ReflectorConfig) (gatewayFilters, error) {
+	var out gatewayFilters
+	for _, filter := range filters {
+		switch filter.Type {
+		case gatewayv1.HTTPRouteFilterRequestHeaderModifier:
+			out.headers.addRequest(filter.RequestHeaderModifier)
+		case gatewayv1.HTTPRouteFilterResponseHeaderModifier:
+			out.headers.addResponse(filter.ResponseHeaderModifier)
+		case gatewayv1.HTTPRouteFilterRequestMirror:
+			if filter.RequestMirror == nil {
+				continue
+			}
+			clusterName, err := resolveBackendRef(filter.RequestMirror.BackendRef, namespace, l, cfg)
+			if err != nil {
+				return out, fmt.Errorf("invalid request mirror: %w", err)
+			}
+			out.mirrors = append(out.mirrors, &routev3.RouteAction_RequestMirrorPolicy{Cluster: clusterName})
+		case gatewayv1.HTTPRouteFilterRequestRedirect:
+			out.redirect = filter.RequestRedirect
+		case gatewayv1.HTTPRouteFilterURLRewrite:
+			out.rewrite = filter.URLRewrite
+		default:
+			return out, fmt.Errorf("unsupported filter %s", filter.Type)
+		}
+	}
+	if out.redirect != nil && out.rewrite != nil {
+		return out, errors.New("the request redirect and the url rewrite filters could not be used together")
+	}
+	return out, nil
+}
+
+// grpcFiltersToHTTPFilters ... the GRPCRoute filters are the subset of the HTTPRoute filters of the same types
+func grpcFiltersToHTTPFilters(filters []gatewayv1.GRPCRouteFilter) []gatewayv1.HTTPRouteFilter {
+	var out []gatewayv1.HTTPRouteFilter
+	for _, filter := range filters {
+		out = append(out, gatewayv1.HTTPRouteFilter{
+			Type:                   gatewayv1.HTTPRouteFilterType(filter.Type),
+			RequestHeaderModifier:  filter.RequestHeaderModifier,
+			ResponseHeaderModifier: filter.ResponseHeaderModifier,
+			RequestMirror:          filter.RequestMirror,
+			ExtensionRef:           filter.ExtensionRef,
+		})
+	}
+	return out
+}
+
+// redirectResponseCodes ... the status codes of the RequestRedirect filter
+var redirectResponseCodes = map[int]routev3.RedirectAction_RedirectResponseCode{
+	301: routev3.RedirectAction_MOVED_PERMANENTLY,
+	302: routev3.RedirectAction_FOUND,
+	303: routev3.RedirectAction_SEE_OTHER,
+	307: routev3.RedirectAction_TEMPORARY_REDIRECT,
+	308: routev3.RedirectAction_PERMANENT_REDIRECT,
+}
+
+// newRedirectAction ... translate the RequestRedirect filter, the status code is 302 by default
+func newRedirectAction(filter *gatewayv1.HTTPRequestRedirectFilter) (*routev3.RedirectAction, error) {
+	out := &routev3.RedirectAction{
+		ResponseCode: routev3.RedirectAction_FOUND,
+	}
+	if filter.StatusCode != nil {
+		code, ok := redirectResponseCodes[*filter.StatusCode]
+		if !ok {
+			return nil, fmt.Errorf("unsupported redirect status code %d", *filter.StatusCode)
+		}
+		out.ResponseCode = code
+	}
+	if filter.Scheme != nil {
+		out.SchemeRewriteSpecifier = &routev3.RedirectAction_SchemeRedirect{SchemeRedirect: *filter.Scheme}
+	}
+	if filter.Hostname != nil {
+		out.HostRedirect = string(*filter.Hostname)
+	}
+	if filter.Port != nil {
+		out.PortRedirect = uint32(*filter.Port)
+	}
+	if path := filter.Path; path != nil {
+		switch {
+		case path.Type == gatewayv1.FullPathHTTPPathModifier && path.ReplaceFullPath != nil:
+			out.PathRewriteSpecifier = &routev3.RedirectAction_PathRedirect{PathRedirect: *path.ReplaceFullPath}
+		case path.Type == gatewayv1.PrefixMatchHTTPPathModifier && path.ReplacePrefixMatch != nil:
+			out.PathRewriteSpecifier = &routev3.RedirectAction_PrefixRewrite{PrefixRewrite: *path.ReplacePrefixMatch}
+		default:
+			return nil, fmt.Errorf("invalid redirect path modifier %s", path.Type)
+		}
+	}
+	return out, nil
+}
+
+// applyURLRewrite ... translate the URLRewrite filter into the route action
+func applyURLRewrite(action *routev3.RouteAction, filter *gatewayv1.HTTPURLRewriteFilter) {
+	if filter == nil {
+		return
+	}
+	if filter.Hostname != nil {
+		action.HostRewriteSpecifier = &routev3.RouteAction_HostRewriteLiteral{HostRewriteLiteral: string(*filter.Hostname)}
+	}
+	if path := filter.Path; path != nil {
+		switch {
+		case path.Type == gatewayv1.FullPathHTTPPathModifier && path.ReplaceFullPath != nil:
+			action.RegexRewrite = &matcherv3.RegexMatchAndSubstitute{
+				Pattern:      &matcherv3.RegexMatcher{Regex: "^/.*$"},
+				Substitution: *path.ReplaceFullPath,
+			}
+		case path.Type == gatewayv1.PrefixMatchHTTPPathModifier && path.ReplacePrefixMatch != nil:
+			action.PrefixRewrite = *path.ReplacePrefixMatch
+		}
+	}
+}
+
+// applyRouteTimeouts ...
+// the request timeout overrides the one of the route policy, the backend request timeout limits each try of the retry policy,
+// or the whole request if there is neither retry policy nor request timeout. a zero timeout disables it
+func applyRouteTimeouts(action *routev3.RouteAction, timeouts *gatewayv1.HTTPRouteTimeouts) error {
+	if timeouts == nil {
+		return nil
+	}
+	if timeouts.Request != nil {
+		timeout, err := parseGatewayDuration(*timeouts.Request)
+		if err != nil {
+			return fmt.Errorf("invalid request timeout: %w", err)
+		}
+		action.Timeout = timeout
+	}
+	if timeouts.BackendRequest != nil {
+		timeout, err := parseGatewayDuration(*timeouts.BackendRequest)
+		if err != nil {
+			return fmt.Errorf("invalid backend request timeout: %w", err)
+		}
+		switch {
+		case action.RetryPolicy != nil:
+			action.RetryPolicy.PerTryTimeout = timeout
+		case timeouts.Request == nil:
+			action.Timeout = timeout
+		}
+	}
+	return nil
+}
+
+func parseGatewayDuration(d gatewayv1.Duration) (*durationpb.Duration, error) {
+	out, err := time.ParseDuration(string(d))
+	if err != nil {
+		return nil, err
+	}
+	if out < 0 {
+		return nil, errors.New("must not be negative")
+	}
+	return durationpb.New(out), nil
+}
+
+// headerMutation ... the headers that are modified by the header modifier filters
+type headerMutation struct {
+	requestHeadersToAdd     []*corev3.HeaderValueOption
+	requestHeadersToRemove  []string
+	responseHeadersToAdd    []*corev3.HeaderValueOption
+	responseHeadersToRemove []string
+}
+
+func (h headerMutation) empty() bool {
+	return len(h.requestHeadersToAdd) == 0 && len(h.requestHeadersToRemove) == 0 &&
+		len(h.responseHeadersToAdd) == 0 && len(h.responseHeadersToRemove) == 0
+}
+
+// addRequest ... apply the RequestHeaderModifier filter
+func (h *headerMutation) addRequest(filter *gatewayv1.HTTPHeaderFilter) {
+	if filter == nil {
+		return
+	}
+	h.requestHeadersToAdd = append(h.requestHeadersToAdd, newHeaderValueOptions(filter)...)
+	h.requestHeadersToRemove = append(h.requestHeadersToRemove, filter.Remove...)
+}
+
+// addResponse ... apply the ResponseHeaderModifier filter
+func (h *headerMutation) addResponse(filter *gatewayv1.HTTPHeaderFilter) {
+	if filter == nil {
+		return
+	}
+	h.responseHeadersToAdd = append(h.responseHeadersToAdd, newHeaderValueOptions(filter)...)
+	h.responseHeadersToRemove = append(h.responseHeadersToRemove, filter.Remove...)
+}
+
+func (h headerMutation) applyToRoute(route *routev3.Route) {
+	route.RequestHeadersToAdd = h.requestHeadersToAdd
+	route.RequestHeadersToRemove = h.requestHeadersToRemove
+	route.ResponseHeadersToAdd = h.responseHeadersToAdd
+	route.ResponseHeadersToRemove = h.responseHeadersToRemove
+}
+
+func (h headerMutation) applyToClusterWeight(cluster *routev3.WeightedCluster_ClusterWeight) {
+	cluster.RequestHeadersToAdd = h.requestHeadersToAdd
+	cluster.RequestHeadersToRemove = h.requestHeadersToRemove
+	cluster.ResponseHeadersToAdd = h.responseHeadersToAdd
+	cluster.ResponseHeadersToRemove = h.responseHeadersToRemove
+}
+
+// newHeaderValueOptions ... the set headers overwrite the existing values while the add headers are appended to them
+func newHeaderValueOptions(filter *gatewayv1.HTTPHeaderFilter) []*corev3.HeaderValueOption {
+	var out []*corev3.HeaderValueOption
+	for _, header := range filter.Set {
+		out = append(out, &corev3.HeaderValueOption{
+			Header:       &corev3.HeaderValue{Key: string(header.Name), Value: header.Value},
+			AppendAction: corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+		})
+	}
+	for _, header := range filter.Add {
+		out = append(out, &corev3.HeaderValueOption{
+			Header:       &corev3.HeaderValue{Key: string(header.Name), Value: header.Value},
+			AppendAction: corev3.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD,
+		})
+	}
+	return out
+}
@@ -0,0 +1,84 @@
+package k8sreflector
+
+import (
+	"fmt"
+	"regexp"
+
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
+)
+
+// grpcRouteToRoutes ... creating a route for each match of each rule of a GRPCRoute, a rule without any match matches every request
+func grpcRouteToRoutes(object gatewayRouteObject, rules []gatewayv1.GRPCRouteRule, policy routePolicy, l lookup, cfg ReflectorConfig) []gatewayRouteEntry {
+	var out []gatewayRouteEntry
+	for i, rule := range rules {
+		spec := gatewayRuleSpec{
+			filters: grpcFiltersToHTTPFilters(rule.Filters),
+		}
+		for _, backend := range rule.BackendRefs {
+			spec.backends = append(spec.backends, gatewayBackendSpec{ref: backend.BackendRef, filters: grpcFiltersToHTTPFilters(backend.Filters)})
+		}
+		translated := newGatewayRule(object, i, spec, policy, l, cfg)
+		matches := rule.Matches
+		if len(matches) == 0 {
+			matches = []gatewayv1.GRPCRouteMatch{{}}
+		}
+		for j, match := range matches {
+			routeMatch, precedence := newGRPCRouteMatch(match)
+			out = append(out, gatewayRouteEntry{
+				object:     object,
+				precedence: precedence,
+				route:      translated.route(fmt.Sprintf("%s/%d/%d", object.key(), i, j), routeMatch),
+			})
+		}
+	}
+	return out
+}
+
+// newGRPCRouteMatch ...
+// translate the method and the headers of a GRPCRoute match, the method is matched by the `/<service>/<method>` path
+// of which an omitted service or method matches any of them
+func newGRPCRouteMatch(match gatewayv1.GRPCRouteMatch) (*routev3.RouteMatch, routePrecedence) {
+	out := &routev3.RouteMatch{
+		PathSpecifier: &routev3.RouteMatch_Prefix{Prefix: "/"},
+	}
+	var precedence routePrecedence
+	if method := match.Method; method != nil && (method.Service != nil || method.Method != nil) {
+		var service, name string
+		if method.Service != nil {
+			service = *method.Service
+		}
+		if method.Method != nil {
+			name = *method.Method
+		}
+		precedence.pathLength = len(service) + len(name)
+		regex := method.Type != nil && *method.Type == gatewayv1.GRPCMethodMatchRegularExpression
+		switch {
+		case regex:
+			out.PathSpecifier = &routev3.RouteMatch_SafeRegex{SafeRegex: newStringMatcher(true, "/"+grpcMethodPattern(service, false)+"/"+grpcMethodPattern(name, false)).GetSafeRegex()}
+		case service != "" && name != "":
+			out.PathSpecifier = &routev3.RouteMatch_Path{Path: "/" + service + "/" + name}
+			precedence.exactPath = true
+		case name == "":
+			out.PathSpecifier = &routev3.RouteMatch_Prefix{Prefix: "/" + service + "/"}
+		default:
+			out.PathSpecifier = &routev3.RouteMatch_SafeRegex{SafeRegex: newStringMatcher(true, "/"+grpcMethodPattern(service, true)+"/"+grpcMethodPattern(name, true)).GetSafeRegex()}
+		}
+	}
+	for _, header := range match.Headers {
+		out.Headers = append(out.Headers, newHeaderMatcher(string(header.Name), header.Type, header.Value))
+	}
+	precedence.headers = len(match.Headers)
+	return out, precedence
+}
+
+// grpcMethodPattern ... the regular expression of a service or a method, an empty one matches any of them
+func grpcMethodPattern(value string, quote bool) string {
+	if value == "" {
+		return "[^/]+"
+	}
+	if quote {
+		return regexp.QuoteMeta(value)
+	}
+	return value
+}
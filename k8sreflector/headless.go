@@ -0,0 +1,151 @@
+package k8sreflector
+
+import (
+	"context"
+	"slices"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	k8scache "k8s.io/client-go/tools/cache"
+)
+
+// serviceIndex ... the index of the endpoints, or the endpoint slices, by the namespace/name of their service
+const serviceIndex = "service"
+
+// serviceIndexFunc ... index the endpoints, or the endpoint slices, by the namespace/name of their service
+func serviceIndexFunc(obj interface{}) ([]string, error) {
+	switch o := obj.(type) {
+	case *corev1.Endpoints:
+		return []string{o.Namespace + "/" + o.Name}, nil
+	case *discoveryv1.EndpointSlice:
+		if o.Labels[discoveryv1.LabelServiceName] == "" {
+			return nil, nil
+		}
+		return []string{o.Namespace + "/" + o.Labels[discoveryv1.LabelServiceName]}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// newServicesLookup ...
+// create the caches to translate the services, the pods are watched for the service accounts of the mTLS
+// if the configuration serves some namespaces by mTLS or watches the pods anyway. onPodChange is called with the objects of a changed pod
+func newServicesLookup(ctx context.Context, api kubernetes.Interface, cfg ReflectorConfig, onChange func(), onPodChange func(oldObj, newObj interface{})) lookup {
+	l := lookup{
+		headless: newHeadlessCache(ctx, api, cfg, onChange),
+	}
+	if len(cfg.MTLS.Namespaces) > 0 || cfg.WatchPods || cfg.WeightFromCPURequests {
+		l.pods = newPodCache(ctx, api, cfg, podServiceAccountChanged, onPodChange)
+	}
+	return l
+}
+
+// newHeadlessCache ...
+// create a cache of the endpoints, or the endpoint slices, of the headless services to resolve the names of their pods.
+// only the objects that are labeled by corev1.IsHeadlessService are watched
+func newHeadlessCache(ctx context.Context, api kubernetes.Interface, cfg ReflectorConfig, onChange func()) *objectCache {
+	tweak := func(opts *metav1.ListOptions) {
+		cfg.tweakLookupListOptions(opts, false)
+		opts.LabelSelector = corev1.IsHeadlessService
+	}
+	changed := func(oldObj, newObj interface{}) bool {
+		return !slices.Equal(headlessObjectPodNames(oldObj), headlessObjectPodNames(newObj))
+	}
+	indexers := k8scache.Indexers{
+		serviceIndex: serviceIndexFunc,
+	}
+	if cfg.EndpointSlices {
+		return newObjectCache(cfg.watchNamespaces(), func(namespace string) k8scache.ListerWatcher {
+			return reportListWatchErrors(ctx, &k8scache.ListWatch{
+				ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+					tweak(&opts)
+					return api.DiscoveryV1().EndpointSlices(namespace).List(ctx, opts)
+				},
+				WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+					tweak(&opts)
+					return api.DiscoveryV1().EndpointSlices(namespace).Watch(ctx, opts)
+				},
+			})
+		}, &discoveryv1.EndpointSlice{}, cfg.ResyncPeriod, indexers, nil, changed, onAnyChange(onChange))
+	}
+	return newObjectCache(cfg.watchNamespaces(), func(namespace string) k8scache.ListerWatcher {
+		return reportListWatchErrors(ctx, &k8scache.ListWatch{
+			ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+				tweak(&opts)
+				return api.CoreV1().Endpoints(namespace).List(ctx, opts)
+			},
+			WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+				tweak(&opts)
+				return api.CoreV1().Endpoints(namespace).Watch(ctx, opts)
+			},
+		})
+	}, &corev1.Endpoints{}, cfg.ResyncPeriod, indexers, nil, changed, onAnyChange(onChange))
+}
+
+// headlessPodNames ... the sorted names of the pods of a headless service
+func (l lookup) headlessPodNames(namespace, name string) []string {
+	var out []string
+	for _, obj := range l.headless.byIndex(serviceIndex, namespace+"/"+name) {
+		out = append(out, headlessObjectPodNames(obj)...)
+	}
+	slices.Sort(out)
+	return slices.Compact(out)
+}
+
+// headlessObjectPodNames ... the sorted names of the pods in the endpoints or the endpoint slice
+func headlessObjectPodNames(obj interface{}) []string {
+	var out []string
+	switch o := obj.(type) {
+	case *corev1.Endpoints:
+		for _, subset := range o.Subsets {
+			for _, addrs := range [][]corev1.EndpointAddress{subset.Addresses, subset.NotReadyAddresses} {
+				for _, addr := range addrs {
+					if podName := headlessPodName(addr.Hostname, addr.TargetRef); podName != "" {
+						out = append(out, podName)
+					}
+				}
+			}
+		}
+	case *discoveryv1.EndpointSlice:
+		for _, ep := range o.Endpoints {
+			var hostname string
+			if ep.Hostname != nil {
+				hostname = *ep.Hostname
+			}
+			if podName := headlessPodName(hostname, ep.TargetRef); podName != "" {
+				out = append(out, podName)
+			}
+		}
+	}
+	slices.Sort(out)
+	return slices.Compact(out)
+}
+
+// headlessPodName ... the name to address a pod of a headless service by, that is its hostname or otherwise its name
+func headlessPodName(hostname string, targetRef *corev1.ObjectReference) string {
+	if hostname != "" {
+		return hostname
+	}
+	if targetRef != nil && targetRef.Kind == "Pod" {
+		return targetRef.Name
+	}
+	return ""
+}
+
+// newHeadlessLoadAssignments ...
+// creating an eds resource for each pod of a headless service, named by the pod name followed by the cluster name
+func newHeadlessLoadAssignments(clusterName string, addrs []endpointAddress) []types.Resource {
+	var out []types.Resource
+	for _, addr := range addrs {
+		if addr.podName == "" {
+			continue
+		}
+		out = append(out, newClusterLoadAssignment(headlessClusterName(addr.podName, clusterName), []endpointAddress{addr}))
+	}
+	return out
+}
@@ -0,0 +1,96 @@
+package k8sreflector
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
+)
+
+// httpRouteToRoutes ...
+// creating a route for each match of each rule of an HTTPRoute, a rule without any match matches every request.
+// the path is matched by prefix `/` by default
+func httpRouteToRoutes(object gatewayRouteObject, rules []gatewayv1.HTTPRouteRule, policy routePolicy, l lookup, cfg ReflectorConfig) []gatewayRouteEntry {
+	var out []gatewayRouteEntry
+	for i, rule := range rules {
+		spec := gatewayRuleSpec{
+			filters:  rule.Filters,
+			timeouts: rule.Timeouts,
+		}
+		for _, backend := range rule.BackendRefs {
+			spec.backends = append(spec.backends, gatewayBackendSpec{ref: backend.BackendRef, filters: backend.Filters})
+		}
+		translated := newGatewayRule(object, i, spec, policy, l, cfg)
+		matches := rule.Matches
+		if len(matches) == 0 {
+			matches = []gatewayv1.HTTPRouteMatch{{}}
+		}
+		for j, match := range matches {
+			routeMatch, precedence := newHTTPRouteMatch(match)
+			out = append(out, gatewayRouteEntry{
+				object:     object,
+				precedence: precedence,
+				route:      translated.route(fmt.Sprintf("%s/%d/%d", object.key(), i, j), routeMatch),
+			})
+		}
+	}
+	return out
+}
+
+// setPathPrefix ...
+// match the path prefix on the path element boundaries as the gateway API defines, i.e. /foo matches /foo and /foo/bar but not /foobar,
+// and a trailing / is ignored. it is matched by a regex since the grpc xds clients reject the path_separated_prefix.
+// return the normalized prefix that is matched, so that the prefixes that match the same paths have the same precedence
+func setPathPrefix(match *routev3.RouteMatch, prefix string) string {
+	trimmed := strings.TrimRight(prefix, "/")
+	if trimmed == "" {
+		match.PathSpecifier = &routev3.RouteMatch_Prefix{Prefix: "/"}
+		return "/"
+	}
+	match.PathSpecifier = &routev3.RouteMatch_SafeRegex{SafeRegex: newStringMatcher(true, regexp.QuoteMeta(trimmed)+"(/.*)?").GetSafeRegex()}
+	return trimmed
+}
+
+// newHTTPRouteMatch ... translate the path, the headers, the method and the query parameters of an HTTPRoute match
+func newHTTPRouteMatch(match gatewayv1.HTTPRouteMatch) (*routev3.RouteMatch, routePrecedence) {
+	out := &routev3.RouteMatch{
+		PathSpecifier: &routev3.RouteMatch_Prefix{Prefix: "/"},
+	}
+	var precedence routePrecedence
+	if path := match.Path; path != nil && path.Value != nil {
+		matchType := gatewayv1.PathMatchPathPrefix
+		if path.Type != nil {
+			matchType = *path.Type
+		}
+		switch matchType {
+		case gatewayv1.PathMatchExact:
+			out.PathSpecifier = &routev3.RouteMatch_Path{Path: *path.Value}
+			precedence.exactPath = true
+			precedence.pathLength = len(*path.Value)
+		case gatewayv1.PathMatchRegularExpression:
+			out.PathSpecifier = &routev3.RouteMatch_SafeRegex{SafeRegex: newStringMatcher(true, *path.Value).GetSafeRegex()}
+		default:
+			precedence.pathLength = len(setPathPrefix(out, *path.Value))
+		}
+	}
+	for _, header := range match.Headers {
+		out.Headers = append(out.Headers, newHeaderMatcher(string(header.Name), header.Type, header.Value))
+	}
+	precedence.headers = len(match.Headers)
+	if match.Method != nil {
+		out.Headers = append(out.Headers, newHeaderMatcher(":method", nil, string(*match.Method)))
+		precedence.method = true
+	}
+	for _, param := range match.QueryParams {
+		out.QueryParameters = append(out.QueryParameters, &routev3.QueryParameterMatcher{
+			Name: string(param.Name),
+			QueryParameterMatchSpecifier: &routev3.QueryParameterMatcher_StringMatch{
+				StringMatch: newStringMatcher(param.Type != nil && *param.Type == gatewayv1.QueryParamMatchRegularExpression, param.Value),
+			},
+		})
+	}
+	precedence.queryParams = len(match.QueryParams)
+	return out, precedence
+}
@@ -0,0 +1,212 @@
+package k8sreflector
+
+import (
+	"context"
+	"encoding/binary"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8scache "k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// incrementalReflector ...
+// runs an informer for each namespace to watch and keeps the translated resources of each object,
+// only the objects that an event has changed are translated again and nothing is pushed if their resources are the same.
+// the translation key of an object is usually its namespace/name, but the objects that are translated together,
+// e.g. the endpoint slices of a service, share the same key
+type incrementalReflector struct {
+	objects *objectCache
+	// keys maps an object into the keys of its translation
+	keys func(obj interface{}) []string
+	// translate translates the objects of the key, the objects are read from the objects cache
+	// and the invalid annotations that they have are reported by the reports of the key
+	translate func(key string, reports *annotationReports) []types.Resource
+	push      func(version string, resources []types.Resource)
+	versions  *contentVersions
+	// mu guards the translated resources and serializes the pushes
+	mu         sync.Mutex
+	synced     bool
+	translated map[string]translatedResources
+	pushed     bool
+}
+
+// translatedResources ...
+// the translated resources of a key and their hash to detect the changes, and the invalid annotations that the translation has reported.
+// a key without resources is kept as long as it reports some, e.g. a service that is not exported by an invalid annotation
+type translatedResources struct {
+	resources []types.Resource
+	hash      uint64
+	reports   *annotationReports
+}
+
+// newIncrementalReflector ...
+// create the informers of the objects, the push is called with every translated resource whenever some of them have been changed.
+// the version of each push is derived from the content of the resources
+func newIncrementalReflector(namespaces []string, lw func(namespace string) k8scache.ListerWatcher, obj runtime.Object, resyncPeriod time.Duration, indexers k8scache.Indexers, keys func(obj interface{}) []string, translate func(key string, reports *annotationReports) []types.Resource, versions *contentVersions, push func(version string, resources []types.Resource)) *incrementalReflector {
+	out := &incrementalReflector{
+		objects:    &objectCache{},
+		keys:       keys,
+		translate:  translate,
+		push:       push,
+		versions:   versions,
+		translated: map[string]translatedResources{},
+	}
+	for _, ns := range namespaces {
+		informer := k8scache.NewSharedIndexInformer(lw(ns), obj, resyncPeriod, indexers)
+		informer.AddEventHandler(k8scache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				out.update(keys(obj))
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				out.update(append(keys(oldObj), keys(newObj)...))
+			},
+			DeleteFunc: func(obj interface{}) {
+				if tombstone, ok := obj.(k8scache.DeletedFinalStateUnknown); ok {
+					obj = tombstone.Obj
+				}
+				out.update(keys(obj))
+			},
+		})
+		out.objects.informers = append(out.objects.informers, informer)
+	}
+	return out
+}
+
+// run ... run the informers until the ctx is done, every object is translated once all of them have been synced
+func (r *incrementalReflector) run(ctx context.Context, syncTimeout time.Duration) error {
+	var synced []k8scache.InformerSynced
+	for _, informer := range r.objects.informers {
+		go informer.Run(ctx.Done())
+		synced = append(synced, informer.HasSynced)
+	}
+	err := waitForCacheSync(ctx, syncTimeout, synced...)
+	if err != nil || ctx.Err() != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.synced = true
+	r.translateAll()
+	r.mu.Unlock()
+	<-ctx.Done()
+	return nil
+}
+
+// update ... translate the objects of the keys again, the events before the informers have been synced are translated by the run
+func (r *incrementalReflector) update(keys []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.synced {
+		return
+	}
+	changed := false
+	for _, key := range keys {
+		if r.translateKey(key) {
+			changed = true
+		}
+	}
+	if changed {
+		r.pushAll()
+	}
+}
+
+// repush ... translate every object again, e.g. when something that the translation relies on has been changed
+func (r *incrementalReflector) repush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.synced {
+		r.translateAll()
+	}
+}
+
+// translateAll ... translate every object and push if anything has been changed, the caller must hold the mu
+func (r *incrementalReflector) translateAll() {
+	keys := map[string]struct{}{}
+	for _, informer := range r.objects.informers {
+		for _, obj := range informer.GetStore().List() {
+			for _, key := range r.keys(obj) {
+				keys[key] = struct{}{}
+			}
+		}
+	}
+	// the keys that have no object anymore are translated into nothing
+	for key := range r.translated {
+		keys[key] = struct{}{}
+	}
+	changed := false
+	for key := range keys {
+		if r.translateKey(key) {
+			changed = true
+		}
+	}
+	// the first push initializes the snapshot even if there is nothing to translate
+	if changed || !r.pushed {
+		r.pushAll()
+	}
+}
+
+// translateKey ... translate the objects of the key and report whether their resources have been changed, the caller must hold the mu
+func (r *incrementalReflector) translateKey(key string) bool {
+	previous, ok := r.translated[key]
+	reports := previous.reports.next()
+	resources := r.translate(key, reports)
+	hadResources := ok && len(previous.resources) > 0
+	if len(resources) == 0 {
+		// the reports are dropped along with the objects of the key
+		if len(reports.current) == 0 {
+			delete(r.translated, key)
+		} else {
+			r.translated[key] = translatedResources{reports: reports}
+		}
+		return hadResources
+	}
+	hash, err := resourceHash(resources)
+	if err != nil {
+		klog.Error("resource hash failed", "key", key, "err", err)
+	} else if hadResources && hash == previous.hash {
+		previous.reports = reports
+		r.translated[key] = previous
+		return false
+	}
+	r.translated[key] = translatedResources{resources: resources, hash: hash, reports: reports}
+	return true
+}
+
+// pushAll ...
+// push the translated resources of every key, the caller must hold the mu.
+// the content hash of the push combines the hashes of the keys in their order, so the resources are not hashed again
+func (r *incrementalReflector) pushAll() {
+	r.pushed = true
+	keys := make([]string, 0, len(r.translated))
+	for key, translated := range r.translated {
+		if len(translated.resources) > 0 {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	var resources []types.Resource
+	h := xxhash.New()
+	hash := make([]byte, 8)
+	for _, key := range keys {
+		translated := r.translated[key]
+		resources = append(resources, translated.resources...)
+		binary.BigEndian.PutUint64(hash, translated.hash)
+		h.WriteString(key)
+		h.Write(resourceSeparator)
+		h.Write(hash)
+	}
+	r.push(r.versions.version(h.Sum64()), resources)
+}
+
+// metaNamespaceKeys ... translate each object by its own namespace/name key
+func metaNamespaceKeys(obj interface{}) []string {
+	key, err := k8scache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return nil
+	}
+	return []string{key}
+}
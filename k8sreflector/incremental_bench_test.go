@@ -0,0 +1,111 @@
+package k8sreflector
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// benchmarkServices is the number of the services of the benchmarks, each of them has its own endpoints
+const benchmarkServices = 5000
+
+// firstPushSetter ... discards the pushes and signals the first one, it is pushed once the reflector has been synced
+type firstPushSetter struct {
+	once   sync.Once
+	pushed chan struct{}
+}
+
+func (s *firstPushSetter) Set(context.Context, string, []types.Resource) {
+	s.once.Do(func() {
+		close(s.pushed)
+	})
+}
+
+// newBenchmarkEndpointReflector ... run an endpoints reflector against a fake clientset of the services until it has been synced
+func newBenchmarkEndpointReflector(b *testing.B) *EndpointReflector {
+	b.Helper()
+	objs := make([]runtime.Object, 0, 2*benchmarkServices)
+	for i := range benchmarkServices {
+		meta := metav1.ObjectMeta{Namespace: "default", Name: "svc-" + strconv.Itoa(i)}
+		objs = append(objs, &corev1.Service{
+			ObjectMeta: meta,
+			Spec: corev1.ServiceSpec{
+				Ports: []corev1.ServicePort{{Name: "grpc", Port: 8080}},
+			},
+		}, &corev1.Endpoints{
+			ObjectMeta: meta,
+			Subsets: []corev1.EndpointSubset{{
+				Addresses: []corev1.EndpointAddress{
+					{IP: fmt.Sprintf("10.0.%d.1", i%256)},
+					{IP: fmt.Sprintf("10.0.%d.2", i%256)},
+					{IP: fmt.Sprintf("10.0.%d.3", i%256)},
+				},
+				Ports: []corev1.EndpointPort{{Name: "grpc", Port: 8080}},
+			}},
+		})
+	}
+	setter := &firstPushSetter{pushed: make(chan struct{})}
+	r := NewEndpointReflector(fake.NewSimpleClientset(objs...), setter, ReflectorConfig{})
+	ctx, cancel := context.WithCancel(context.Background())
+	b.Cleanup(cancel)
+	go func() {
+		_ = r.Watch(ctx)
+	}()
+	<-setter.pushed
+	return r
+}
+
+// changeEndpoints ... change an address of the endpoints of the first service in the store of the reflector
+func changeEndpoints(b *testing.B, r *EndpointReflector, i int) *corev1.Endpoints {
+	obj, ok := r.refl.objects.get("default/svc-0")
+	if !ok {
+		b.Fatal("the endpoints have not been synced")
+	}
+	changed := obj.(*corev1.Endpoints).DeepCopy()
+	changed.Subsets[0].Addresses[0].IP = fmt.Sprintf("10.1.%d.%d", i/256%256, i%256)
+	err := r.refl.objects.informers[0].GetStore().Update(changed)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return changed
+}
+
+// BenchmarkEndpointsFullRebuild ... translate and hash every endpoints on each change, as the reflector did before it was incremental
+func BenchmarkEndpointsFullRebuild(b *testing.B) {
+	r := newBenchmarkEndpointReflector(b)
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		changeEndpoints(b, r, i)
+		var eps []*corev1.Endpoints
+		for _, obj := range r.refl.objects.informers[0].GetStore().List() {
+			eps = append(eps, obj.(*corev1.Endpoints))
+		}
+		resources := endpointsToResources(eps, r.lookup, r.cfg)
+		hash, err := resourceHash(resources)
+		if err != nil {
+			b.Fatal(err)
+		}
+		r.snap.Set(ctx, strconv.FormatUint(hash, 16), resources)
+	}
+}
+
+// BenchmarkEndpointsIncremental ... only translate the changed endpoints as the event handler of the reflector does
+func BenchmarkEndpointsIncremental(b *testing.B) {
+	r := newBenchmarkEndpointReflector(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		changed := changeEndpoints(b, r, i)
+		r.refl.update(metaNamespaceKeys(changed))
+	}
+}
@@ -0,0 +1,93 @@
+package k8sreflector
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// endpointAddress ... a single backend address of a cluster regardless of the k8s API it was read from
+type endpointAddress struct {
+	ip       string
+	port     uint32
+	hostname string
+	health   corev3.HealthStatus
+	locality locality
+	// weight is the load balancing weight of the address, zero means unset
+	weight uint32
+	// podName is the name to address the pod by when it belongs to a headless service
+	podName string
+}
+
+// addressHostname ...
+// resolve the hostname of an address, fallback to the target pod and then to the node name
+func addressHostname(hostname string, targetRef *corev1.ObjectReference, nodeName *string) string {
+	if hostname == "" && targetRef != nil {
+		hostname = fmt.Sprintf("%s.%s", targetRef.Name, targetRef.Namespace)
+	}
+	if hostname == "" && nodeName != nil {
+		hostname = *nodeName
+	}
+	return hostname
+}
+
+// newClusterLoadAssignment ...
+// creating an eds resource from the addresses, the addresses are grouped by their locality
+// and each locality is weighted by the sum of the weights of its endpoints, an endpoint without weight counts as one.
+// both localities and addresses are sorted to keep the output stable
+func newClusterLoadAssignment(clusterName string, addrs []endpointAddress) *endpointv3.ClusterLoadAssignment {
+	slices.SortStableFunc(addrs, func(a, b endpointAddress) int {
+		return cmp.Or(
+			cmp.Compare(a.locality.region, b.locality.region),
+			cmp.Compare(a.locality.zone, b.locality.zone),
+			cmp.Compare(a.locality.subZone, b.locality.subZone),
+			cmp.Compare(a.ip, b.ip),
+		)
+	})
+	cla := &endpointv3.ClusterLoadAssignment{
+		ClusterName: clusterName,
+		Endpoints:   []*endpointv3.LocalityLbEndpoints{},
+	}
+	var current *endpointv3.LocalityLbEndpoints
+	for i, addr := range addrs {
+		if i == 0 || addr.locality != addrs[i-1].locality {
+			current = &endpointv3.LocalityLbEndpoints{
+				Locality:    addr.locality.toProto(),
+				LbEndpoints: []*endpointv3.LbEndpoint{},
+			}
+			cla.Endpoints = append(cla.Endpoints, current)
+		}
+		lbEndpoint := &endpointv3.LbEndpoint{
+			HealthStatus: addr.health,
+			HostIdentifier: &endpointv3.LbEndpoint_Endpoint{
+				Endpoint: &endpointv3.Endpoint{
+					Address: &corev3.Address{
+						Address: &corev3.Address_SocketAddress{
+							SocketAddress: &corev3.SocketAddress{
+								Protocol: corev3.SocketAddress_TCP,
+								Address:  addr.ip,
+								PortSpecifier: &corev3.SocketAddress_PortValue{
+									PortValue: addr.port,
+								},
+							},
+						},
+					},
+					Hostname: addr.hostname,
+				},
+			},
+		}
+		weight := uint32(1)
+		if addr.weight > 0 {
+			weight = addr.weight
+			lbEndpoint.LoadBalancingWeight = wrapperspb.UInt32(addr.weight)
+		}
+		current.LbEndpoints = append(current.LbEndpoints, lbEndpoint)
+		current.LoadBalancingWeight = wrapperspb.UInt32(current.GetLoadBalancingWeight().GetValue() + weight)
+	}
+	return cla
+}
@@ -0,0 +1,245 @@
+package k8sreflector
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/sifer169966/go-xds/reflector"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	k8scache "k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// objectCache ...
+// a read-only informer cache of the objects that are related to the ones being translated,
+// there is an informer for each namespace to watch
+type objectCache struct {
+	informers []k8scache.SharedIndexInformer
+}
+
+// newObjectCache ...
+// create an informer cache, the transform strips the objects down to what the translation needs
+// and the onChange will be called with the objects of an event whenever changed reports that the event affects the translation.
+// both receive a nil oldObj for an added object and a nil newObj for a deleted one
+func newObjectCache(namespaces []string, lw func(namespace string) k8scache.ListerWatcher, obj runtime.Object, resyncPeriod time.Duration, indexers k8scache.Indexers, transform k8scache.TransformFunc, changed func(oldObj, newObj interface{}) bool, onChange func(oldObj, newObj interface{})) *objectCache {
+	out := &objectCache{}
+	for _, ns := range namespaces {
+		informer := k8scache.NewSharedIndexInformer(lw(ns), obj, resyncPeriod, indexers)
+		informer.SetTransform(transform)
+		informer.AddEventHandler(k8scache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				if changed(nil, obj) {
+					onChange(nil, obj)
+				}
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				if changed(oldObj, newObj) {
+					onChange(oldObj, newObj)
+				}
+			},
+			DeleteFunc: func(obj interface{}) {
+				if tombstone, ok := obj.(k8scache.DeletedFinalStateUnknown); ok {
+					obj = tombstone.Obj
+				}
+				if changed(obj, nil) {
+					onChange(obj, nil)
+				}
+			},
+		})
+		out.informers = append(out.informers, informer)
+	}
+	return out
+}
+
+// onAnyChange ... the onChange of an objectCache that does not depend on which objects have been changed
+func onAnyChange(onChange func()) func(oldObj, newObj interface{}) {
+	return func(interface{}, interface{}) {
+		onChange()
+	}
+}
+
+// get ... get the object by its namespace/name key, it is safe to call on a nil *objectCache
+func (c *objectCache) get(key string) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+	for _, informer := range c.informers {
+		obj, ok, err := informer.GetStore().GetByKey(key)
+		if err == nil && ok {
+			return obj, true
+		}
+	}
+	return nil, false
+}
+
+// byIndex ... list the objects of the index, it is safe to call on a nil *objectCache
+func (c *objectCache) byIndex(indexName, indexedValue string) []interface{} {
+	if c == nil {
+		return nil
+	}
+	var out []interface{}
+	for _, informer := range c.informers {
+		objs, err := informer.GetIndexer().ByIndex(indexName, indexedValue)
+		if err == nil {
+			out = append(out, objs...)
+		}
+	}
+	return out
+}
+
+// lookup ...
+// the caches that are used while translating the objects, the ones that are not enabled by the configuration are nil
+type lookup struct {
+	services *objectCache
+	nodes    *objectCache
+	pods     *objectCache
+	headless *objectCache
+	// reports is the invalid annotations that have been reported by the translation that the lookup is used by
+	reports *annotationReports
+}
+
+// newLookup ...
+// create the caches to translate the endpoints that are enabled by the configuration,
+// the services are read from the serviceAPI and the nodes and the pods from the api of the endpoints.
+// onPodChange is called with the objects of a changed pod
+func newLookup(ctx context.Context, api kubernetes.Interface, serviceAPI kubernetes.Interface, cfg ReflectorConfig, onChange func(), onPodChange func(oldObj, newObj interface{})) lookup {
+	l := lookup{
+		services: newServiceCache(ctx, serviceAPI, cfg, onChange),
+	}
+	if cfg.TopologyFromNodes {
+		l.nodes = newNodeCache(ctx, api, cfg, onChange)
+	}
+	if cfg.WatchPods || cfg.WeightFromCPURequests {
+		l.pods = newPodCache(ctx, api, cfg, podEndpointChanged(cfg), onPodChange)
+	}
+	return l
+}
+
+// run ... start the informers in separate goroutines and wait until all of them have been synced
+func (l lookup) run(ctx context.Context, syncTimeout time.Duration) error {
+	var synced []k8scache.InformerSynced
+	for _, c := range []*objectCache{l.services, l.nodes, l.pods, l.headless} {
+		if c == nil {
+			continue
+		}
+		for _, informer := range c.informers {
+			go informer.Run(ctx.Done())
+			synced = append(synced, informer.HasSynced)
+		}
+	}
+	klog.Info("waiting for lookup caches to be synced")
+	return waitForCacheSync(ctx, syncTimeout, synced...)
+}
+
+// waitForCacheSync ... wait for the informers to be synced, it fails if they have not been synced within the syncTimeout unless it is zero
+func waitForCacheSync(ctx context.Context, syncTimeout time.Duration, synced ...k8scache.InformerSynced) error {
+	stop := ctx.Done()
+	if syncTimeout > 0 {
+		timeoutCtx, cancel := context.WithTimeout(ctx, syncTimeout)
+		defer cancel()
+		stop = timeoutCtx.Done()
+	}
+	if k8scache.WaitForCacheSync(stop, synced...) || ctx.Err() != nil {
+		return nil
+	}
+	return fmt.Errorf("caches have not been synced within %s", syncTimeout)
+}
+
+// service ... get the service of the endpoints, return nil if it is unknown
+func (l lookup) service(namespace, name string) *corev1.Service {
+	obj, ok := l.services.get(namespace + "/" + name)
+	if !ok {
+		return nil
+	}
+	return obj.(*corev1.Service)
+}
+
+// reporting ... the lookup of a translation, the invalid annotations that it reads are reported once by the reports
+func (l lookup) reporting(reports *annotationReports) lookup {
+	l.reports = reports
+	return l
+}
+
+// annotations ... get the annotations of the object, their invalid values are reported by the reports of the translation
+func (l lookup) annotations(obj metav1.Object) annotations {
+	out := newAnnotations(obj)
+	out.reports = l.reports
+	return out
+}
+
+// serviceAnnotations ... get the annotations of the service, there is none if the service is unknown
+func (l lookup) serviceAnnotations(namespace, name string) annotations {
+	svc := l.service(namespace, name)
+	if svc == nil {
+		return l.annotations(&metav1.ObjectMeta{Namespace: namespace, Name: name})
+	}
+	return l.annotations(svc)
+}
+
+// locality ... get the locality of the node, return an empty locality if it is unknown
+func (l lookup) locality(nodeName *string) locality {
+	if nodeName == nil {
+		return locality{}
+	}
+	obj, ok := l.nodes.get(*nodeName)
+	if !ok {
+		return locality{}
+	}
+	return nodeToLocality(obj.(*corev1.Node))
+}
+
+// pod ... get the pod that is referenced by an address, return nil if it is unknown or not a pod
+func (l lookup) pod(ref *corev1.ObjectReference) *corev1.Pod {
+	if ref == nil || ref.Kind != "Pod" {
+		return nil
+	}
+	obj, ok := l.pods.get(ref.Namespace + "/" + ref.Name)
+	if !ok {
+		return nil
+	}
+	return obj.(*corev1.Pod)
+}
+
+// podServiceAccounts ... the sorted service accounts of the known pods that are selected by the service
+func (l lookup) podServiceAccounts(svc *corev1.Service) []string {
+	if len(svc.Spec.Selector) == 0 {
+		return nil
+	}
+	selector := labels.SelectorFromSet(svc.Spec.Selector)
+	var out []string
+	for _, obj := range l.pods.byIndex(k8scache.NamespaceIndex, svc.Namespace) {
+		pod := obj.(*corev1.Pod)
+		if pod.Spec.ServiceAccountName != "" && selector.Matches(labels.Set(pod.Labels)) && !slices.Contains(out, pod.Spec.ServiceAccountName) {
+			out = append(out, pod.Spec.ServiceAccountName)
+		}
+	}
+	slices.Sort(out)
+	return out
+}
+
+// reportListWatchErrors ... report the failed lists and watches, that the informers retry by themselves, to the supervisor of the reflector
+func reportListWatchErrors(ctx context.Context, lw *k8scache.ListWatch) *k8scache.ListWatch {
+	listFunc, watchFunc := lw.ListFunc, lw.WatchFunc
+	lw.ListFunc = func(options metav1.ListOptions) (runtime.Object, error) {
+		obj, err := listFunc(options)
+		if err != nil && ctx.Err() == nil {
+			reflector.ReportError(ctx, fmt.Errorf("list failed: %w", err))
+		}
+		return obj, err
+	}
+	lw.WatchFunc = func(options metav1.ListOptions) (watch.Interface, error) {
+		w, err := watchFunc(options)
+		if err != nil && ctx.Err() == nil {
+			reflector.ReportError(ctx, fmt.Errorf("watch failed: %w", err))
+		}
+		return w, err
+	}
+	return lw
+}
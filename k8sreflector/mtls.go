@@ -0,0 +1,143 @@
+package k8sreflector
+
+import (
+	"fmt"
+	"slices"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	matcherv3 "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// MTLSConfig ...
+// the mTLS of the proxyless grpc clients and servers, their certificates and the root certificates to verify the peers
+// are provided by the certificate provider plugins of the `certificate_providers` of their bootstrap configs
+type MTLSConfig struct {
+	// Namespaces are the namespaces of which services are served by mTLS unless they are annotated by AnnotationMTLS=false,
+	// * means every namespace. the services of the other namespaces are only served by mTLS by AnnotationMTLS=true.
+	// the pods are watched for the service accounts of the pods of the services when it is set, which requires the permission to list and watch the pods
+	Namespaces []string
+	// CertProviderInstance is the instance name of the certificate provider of the own certificates of the clients and the servers
+	CertProviderInstance string
+	// CAProviderInstance is the instance name of the certificate provider of the root certificates, default to the CertProviderInstance
+	CAProviderInstance string
+	// TrustDomain is the trust domain of the SPIFFE IDs of the service accounts that the peers are verified by
+	TrustDomain string
+}
+
+func (c MTLSConfig) defaultConfigure() MTLSConfig {
+	if c.CertProviderInstance == "" {
+		c.CertProviderInstance = "default"
+	}
+	if c.CAProviderInstance == "" {
+		c.CAProviderInstance = c.CertProviderInstance
+	}
+	if c.TrustDomain == "" {
+		c.TrustDomain = "cluster.local"
+	}
+	return c
+}
+
+// enabled ... whether the services of the namespace are served by mTLS by default
+func (c MTLSConfig) enabled(namespace string) bool {
+	return slices.Contains(c.Namespaces, "*") || slices.Contains(c.Namespaces, namespace)
+}
+
+// enabledBy ... whether a service is served by mTLS by its AnnotationMTLS, default to whether its namespace is
+func (c MTLSConfig) enabledBy(a annotations, namespace string) bool {
+	return a.bool(AnnotationMTLS, c.enabled(namespace))
+}
+
+// spiffeID ... the SPIFFE ID of a service account, an empty service account makes the prefix of every one of the namespace
+func (c MTLSConfig) spiffeID(namespace string, serviceAccount string) string {
+	return fmt.Sprintf("spiffe://%s/ns/%s/sa/%s", c.TrustDomain, namespace, serviceAccount)
+}
+
+// commonTLSContext ... the tls context of the certificate providers that verifies the peers by the SAN matchers, if any
+func (c MTLSConfig) commonTLSContext(sans []*matcherv3.StringMatcher) *tlsv3.CommonTlsContext {
+	return &tlsv3.CommonTlsContext{
+		TlsCertificateProviderInstance: &tlsv3.CertificateProviderPluginInstance{
+			InstanceName: c.CertProviderInstance,
+		},
+		ValidationContextType: &tlsv3.CommonTlsContext_CombinedValidationContext{
+			CombinedValidationContext: &tlsv3.CommonTlsContext_CombinedCertificateValidationContext{
+				DefaultValidationContext: &tlsv3.CertificateValidationContext{
+					MatchSubjectAltNames: sans,
+				},
+				ValidationContextCertificateProviderInstance: &tlsv3.CommonTlsContext_CertificateProviderInstance{
+					InstanceName: c.CAProviderInstance,
+				},
+			},
+		},
+	}
+}
+
+// downstreamTransportSocket ... the transport socket of the server listeners that requires the client certificates
+func (c MTLSConfig) downstreamTransportSocket() *corev3.TransportSocket {
+	return newTLSTransportSocket(&tlsv3.DownstreamTlsContext{
+		CommonTlsContext:         c.commonTLSContext(nil),
+		RequireClientCertificate: wrapperspb.Bool(true),
+	})
+}
+
+// mtlsPolicy ... the mTLS of the clusters of a service that is read from its annotations and the MTLSConfig
+type mtlsPolicy struct {
+	cfg     MTLSConfig
+	enabled bool
+	// sans are the SPIFFE IDs of the service accounts of the pods of the service that the clients verify
+	sans []*matcherv3.StringMatcher
+}
+
+// newMTLSPolicy ...
+// read whether the service is served by mTLS from the annotations, its pods are verified by the service accounts of the AnnotationServiceAccounts,
+// or otherwise by the service accounts of the pods that the service selects. the pods of a service without either, e.g. when the pods
+// are not watched or the service has no selector, are verified by any service account of its namespace
+func newMTLSPolicy(a annotations, svc *corev1.Service, l lookup, cfg MTLSConfig) mtlsPolicy {
+	out := mtlsPolicy{
+		cfg:     cfg,
+		enabled: cfg.enabledBy(a, svc.Namespace),
+	}
+	if !out.enabled {
+		return out
+	}
+	serviceAccounts := a.names(AnnotationServiceAccounts)
+	if len(serviceAccounts) == 0 {
+		serviceAccounts = l.podServiceAccounts(svc)
+	}
+	if len(serviceAccounts) == 0 {
+		out.sans = []*matcherv3.StringMatcher{{
+			MatchPattern: &matcherv3.StringMatcher_Prefix{Prefix: cfg.spiffeID(svc.Namespace, "")},
+		}}
+		return out
+	}
+	for _, sa := range serviceAccounts {
+		out.sans = append(out.sans, newStringMatcher(false, cfg.spiffeID(svc.Namespace, sa)))
+	}
+	return out
+}
+
+func (p mtlsPolicy) apply(cds *clusterv3.Cluster) {
+	if !p.enabled {
+		return
+	}
+	cds.TransportSocket = newTLSTransportSocket(&tlsv3.UpstreamTlsContext{
+		CommonTlsContext: p.cfg.commonTLSContext(p.sans),
+	})
+}
+
+// newTLSTransportSocket ... the tls transport socket of the tls context
+func newTLSTransportSocket(tlsContext proto.Message) *corev3.TransportSocket {
+	typedConfig, _ := anypb.New(tlsContext)
+	return &corev3.TransportSocket{
+		Name: wellknown.TransportSocketTls,
+		ConfigType: &corev3.TransportSocket_TypedConfig{
+			TypedConfig: typedConfig,
+		},
+	}
+}
@@ -0,0 +1,76 @@
+package k8sreflector
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	k8scache "k8s.io/client-go/tools/cache"
+)
+
+// namespacedReflector ...
+// runs a k8s reflector for each namespace to watch and pushes the objects of every namespace together.
+// nothing is pushed until every namespace has been listed to not publish a partial snapshot
+type namespacedReflector struct {
+	reflectors []*k8scache.Reflector
+	push       func(v []interface{})
+	// mu guards the objects and serializes the pushes
+	mu      sync.Mutex
+	objects map[int][]interface{}
+}
+
+// newNamespacedReflector ... create a k8s reflector with its own store for each namespace
+func newNamespacedReflector(namespaces []string, lw func(namespace string) k8scache.ListerWatcher, expectedType runtime.Object, resyncPeriod time.Duration, push func(v []interface{})) *namespacedReflector {
+	out := &namespacedReflector{
+		push:    push,
+		objects: map[int][]interface{}{},
+	}
+	for i, ns := range namespaces {
+		store := k8scache.NewUndeltaStore(out.pushFunc(i), k8scache.DeletionHandlingMetaNamespaceKeyFunc)
+		out.reflectors = append(out.reflectors, k8scache.NewReflector(lw(ns), expectedType, store, resyncPeriod))
+	}
+	return out
+}
+
+func (n *namespacedReflector) pushFunc(i int) func(v []interface{}) {
+	return func(v []interface{}) {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		n.objects[i] = v
+		if len(n.objects) == len(n.reflectors) {
+			n.push(n.list())
+		}
+	}
+}
+
+// run ... run the reflectors until the ctx is done
+func (n *namespacedReflector) run(ctx context.Context) {
+	wg := sync.WaitGroup{}
+	for _, refl := range n.reflectors {
+		wg.Add(1)
+		go func(refl *k8scache.Reflector) {
+			defer wg.Done()
+			refl.Run(ctx.Done())
+		}(refl)
+	}
+	wg.Wait()
+}
+
+// repush ... push the current objects again, e.g. when something that the translation relies on has been changed
+func (n *namespacedReflector) repush() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	// nothing to re-translate until every namespace has been listed
+	if len(n.objects) == len(n.reflectors) {
+		n.push(n.list())
+	}
+}
+
+func (n *namespacedReflector) list() []interface{} {
+	var out []interface{}
+	for i := range n.reflectors {
+		out = append(out, n.objects[i]...)
+	}
+	return out
+}
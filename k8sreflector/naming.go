@@ -0,0 +1,71 @@
+package k8sreflector
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// DefaultClusterNameTemplate ... the default template of the cluster names, e.g. svc.ns:grpc
+const DefaultClusterNameTemplate = "{service}.{namespace}:{port}"
+
+// the placeholders of the cluster name template,
+// {port} is the name of the service port or its number if the port is unnamed
+const (
+	clusterNameService    = "{service}"
+	clusterNameNamespace  = "{namespace}"
+	clusterNamePort       = "{port}"
+	clusterNamePortName   = "{port_name}"
+	clusterNamePortNumber = "{port_number}"
+)
+
+// validateClusterNameTemplate ... the template must identify the service and its port to produce the unique names
+func validateClusterNameTemplate(template string) error {
+	if !strings.Contains(template, clusterNameService) || !strings.Contains(template, clusterNameNamespace) {
+		return errors.New("cluster name template must contain both " + clusterNameService + " and " + clusterNameNamespace)
+	}
+	if !strings.Contains(template, clusterNamePort) && !strings.Contains(template, clusterNamePortName) && !strings.Contains(template, clusterNamePortNumber) {
+		return errors.New("cluster name template must contain one of " + clusterNamePort + ", " + clusterNamePortName + " or " + clusterNamePortNumber)
+	}
+	return nil
+}
+
+// clusterName ...
+// the name of the cluster of a service port, it is the only source of the cluster names for both cds and eds resources
+func (r ReflectorConfig) clusterName(namespace, service string, port corev1.ServicePort) string {
+	portNumber := strconv.Itoa(int(port.Port))
+	portNameOrNumber := port.Name
+	if portNameOrNumber == "" {
+		portNameOrNumber = portNumber
+	}
+	return strings.NewReplacer(
+		clusterNameService, service,
+		clusterNameNamespace, namespace,
+		clusterNamePort, portNameOrNumber,
+		clusterNamePortName, port.Name,
+		clusterNamePortNumber, portNumber,
+	).Replace(r.ClusterNameTemplate)
+}
+
+// headlessClusterName ... the name of the cluster of a pod of a headless service
+func headlessClusterName(podName, clusterName string) string {
+	return podName + "." + clusterName
+}
+
+// servicePort ...
+// resolve the service port of an endpoint port, the port name is the only thing they have in common
+// since the port number of an endpoint is the target port. it is not resolved if the service or its port is unknown,
+// then the endpoints are skipped until the event of the service translates them again
+func servicePort(svc *corev1.Service, portName string) (corev1.ServicePort, bool) {
+	if svc == nil {
+		return corev1.ServicePort{}, false
+	}
+	for _, port := range svc.Spec.Ports {
+		if port.Name == portName {
+			return port, true
+		}
+	}
+	return corev1.ServicePort{}, false
+}
@@ -0,0 +1,72 @@
+package k8sreflector
+
+import (
+	"context"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	k8scache "k8s.io/client-go/tools/cache"
+)
+
+// LabelTopologySubZone ... the node label that holds the sub-zone of the locality, k8s has no well-known label for it
+const LabelTopologySubZone = "topology.go-xds.io/sub-zone"
+
+// locality ... comparable form of *corev3.Locality to group the endpoints by
+type locality struct {
+	region  string
+	zone    string
+	subZone string
+}
+
+func (l locality) toProto() *corev3.Locality {
+	return &corev3.Locality{
+		Region:  l.region,
+		Zone:    l.zone,
+		SubZone: l.subZone,
+	}
+}
+
+func nodeToLocality(node *corev1.Node) locality {
+	return locality{
+		region:  node.Labels[corev1.LabelTopologyRegion],
+		zone:    node.Labels[corev1.LabelTopologyZone],
+		subZone: node.Labels[LabelTopologySubZone],
+	}
+}
+
+// newNodeCache ...
+// create a cache of the node labels to resolve the locality of the endpoints that are running on them
+func newNodeCache(ctx context.Context, api kubernetes.Interface, cfg ReflectorConfig, onChange func()) *objectCache {
+	// nodes are cluster scoped
+	return newObjectCache([]string{metav1.NamespaceAll}, func(string) k8scache.ListerWatcher {
+		return reportListWatchErrors(ctx, &k8scache.ListWatch{
+			ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+				return api.CoreV1().Nodes().List(ctx, opts)
+			},
+			WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+				return api.CoreV1().Nodes().Watch(ctx, opts)
+			},
+		})
+	}, &corev1.Node{}, cfg.ResyncPeriod, k8scache.Indexers{}, func(obj interface{}) (interface{}, error) {
+		// the node status is huge and we only care about the labels
+		node, ok := obj.(*corev1.Node)
+		if !ok {
+			return obj, nil
+		}
+		return &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            node.Name,
+				Labels:          node.Labels,
+				ResourceVersion: node.ResourceVersion,
+			},
+		}, nil
+	}, func(oldObj, newObj interface{}) bool {
+		oldNode, oldOk := oldObj.(*corev1.Node)
+		newNode, newOk := newObj.(*corev1.Node)
+		return oldOk && newOk && nodeToLocality(oldNode) != nodeToLocality(newNode)
+	}, onAnyChange(onChange))
+}
@@ -0,0 +1,189 @@
+package k8sreflector
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	k8scache "k8s.io/client-go/tools/cache"
+)
+
+// maxEndpointWeight ... the upper bound of the endpoint weights to keep the sum of a locality within uint32
+const maxEndpointWeight = 10000
+
+// cpuRequestMillisPerWeight ... the cpu requests of a pod in millicores that count as a weight of one
+const cpuRequestMillisPerWeight = 100
+
+// podIndex ... the index of the endpoints, or the endpoint slices, by the namespace/name of the pods of their addresses
+const podIndex = "pod"
+
+// podIndexFunc ... index the endpoints, or the endpoint slices, by the namespace/name of the pods of their addresses
+func podIndexFunc(obj interface{}) ([]string, error) {
+	var refs []*corev1.ObjectReference
+	switch o := obj.(type) {
+	case *corev1.Endpoints:
+		for _, subset := range o.Subsets {
+			for _, addr := range slices.Concat(subset.Addresses, subset.NotReadyAddresses) {
+				refs = append(refs, addr.TargetRef)
+			}
+		}
+	case *discoveryv1.EndpointSlice:
+		for _, ep := range o.Endpoints {
+			refs = append(refs, ep.TargetRef)
+		}
+	}
+	var out []string
+	for _, ref := range refs {
+		if ref != nil && ref.Kind == "Pod" && !slices.Contains(out, ref.Namespace+"/"+ref.Name) {
+			out = append(out, ref.Namespace+"/"+ref.Name)
+		}
+	}
+	return out, nil
+}
+
+// podKeys ... the translation keys of the endpoints, or the endpoint slices, that refer to the pods
+func (r *incrementalReflector) podKeys(pods ...interface{}) []string {
+	var out []string
+	for _, obj := range pods {
+		pod, ok := obj.(*corev1.Pod)
+		if !ok {
+			continue
+		}
+		for _, refObj := range r.objects.byIndex(podIndex, pod.Namespace+"/"+pod.Name) {
+			out = append(out, r.keys(refObj)...)
+		}
+	}
+	return out
+}
+
+// newPodCache ...
+// create a cache of the pods that are referenced by the endpoint addresses or selected by the services, indexed by their namespaces.
+// the changed tells which changes of the pods affect the translation
+func newPodCache(ctx context.Context, api kubernetes.Interface, cfg ReflectorConfig, changed func(oldPod, newPod *corev1.Pod) bool, onChange func(oldObj, newObj interface{})) *objectCache {
+	return newObjectCache(cfg.watchNamespaces(), func(namespace string) k8scache.ListerWatcher {
+		return reportListWatchErrors(ctx, &k8scache.ListWatch{
+			ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+				cfg.tweakLookupListOptions(&opts, false)
+				return api.CoreV1().Pods(namespace).List(ctx, opts)
+			},
+			WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+				cfg.tweakLookupListOptions(&opts, false)
+				return api.CoreV1().Pods(namespace).Watch(ctx, opts)
+			},
+		})
+	}, &corev1.Pod{}, cfg.ResyncPeriod, k8scache.Indexers{k8scache.NamespaceIndex: k8scache.MetaNamespaceIndexFunc}, func(obj interface{}) (interface{}, error) {
+		// keep only what the translation needs, there are a lot of pods in a cluster
+		pod, ok := obj.(*corev1.Pod)
+		if !ok {
+			return obj, nil
+		}
+		out := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              pod.Name,
+				Namespace:         pod.Namespace,
+				Labels:            pod.Labels,
+				Annotations:       xdsAnnotations(pod.Annotations),
+				ResourceVersion:   pod.ResourceVersion,
+				DeletionTimestamp: pod.DeletionTimestamp,
+			},
+			Spec: corev1.PodSpec{
+				ServiceAccountName: pod.Spec.ServiceAccountName,
+			},
+		}
+		for _, container := range pod.Spec.Containers {
+			out.Spec.Containers = append(out.Spec.Containers, corev1.Container{
+				Name: container.Name,
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{
+						corev1.ResourceCPU: container.Resources.Requests[corev1.ResourceCPU],
+					},
+				},
+			})
+		}
+		return out, nil
+	}, func(oldObj, newObj interface{}) bool {
+		oldPod, _ := oldObj.(*corev1.Pod)
+		newPod, _ := newObj.(*corev1.Pod)
+		return changed(oldPod, newPod)
+	}, onChange)
+}
+
+// podEndpointChanged ... whether a change of a pod affects the endpoints that refer to it
+func podEndpointChanged(cfg ReflectorConfig) func(oldPod, newPod *corev1.Pod) bool {
+	return func(oldPod, newPod *corev1.Pod) bool {
+		// the endpoints are not updated when a pod that tolerates unready endpoints starts terminating
+		if oldPod != nil && newPod != nil && isPodTerminating(oldPod) != isPodTerminating(newPod) {
+			return true
+		}
+		// an endpoint may refer to a pod before the pod has been seen by the informer
+		return podWeightAnnotation(oldPod) != podWeightAnnotation(newPod) ||
+			(cfg.WeightFromCPURequests && podCPURequestMillis(oldPod) != podCPURequestMillis(newPod))
+	}
+}
+
+// podServiceAccountChanged ... whether a change of a pod affects the service accounts of the services that select it
+func podServiceAccountChanged(oldPod, newPod *corev1.Pod) bool {
+	if oldPod == nil || newPod == nil {
+		return true
+	}
+	return oldPod.Spec.ServiceAccountName != newPod.Spec.ServiceAccountName || !maps.Equal(oldPod.Labels, newPod.Labels)
+}
+
+func isPodTerminating(pod *corev1.Pod) bool {
+	return pod != nil && pod.DeletionTimestamp != nil
+}
+
+// podWeight ...
+// the load balancing weight of the endpoint of a pod from the AnnotationWeight of the pod,
+// optionally fallback to a weight of one per cpuRequestMillisPerWeight of the cpu requests of the pod.
+// return zero if the pod is unknown or has no weight
+func podWeight(pod *corev1.Pod, l lookup, fromCPURequests bool) uint32 {
+	if pod == nil {
+		return 0
+	}
+	a := l.annotations(pod)
+	if weight := a.uint32(AnnotationWeight); weight != nil {
+		if weight.GetValue() > maxEndpointWeight {
+			a.invalid(AnnotationWeight, errors.New("must not be greater than "+strconv.Itoa(maxEndpointWeight)))
+		} else {
+			return weight.GetValue()
+		}
+	}
+	if !fromCPURequests {
+		return 0
+	}
+	millis := podCPURequestMillis(pod)
+	if millis == 0 {
+		return 0
+	}
+	return uint32(min(max(millis/cpuRequestMillisPerWeight, 1), maxEndpointWeight))
+}
+
+func podWeightAnnotation(pod *corev1.Pod) string {
+	if pod == nil {
+		return ""
+	}
+	return pod.Annotations[AnnotationWeight]
+}
+
+// podCPURequestMillis ... the sum of the cpu requests of the containers of a pod in millicores
+func podCPURequestMillis(pod *corev1.Pod) int64 {
+	if pod == nil {
+		return 0
+	}
+	var out int64
+	for _, container := range pod.Spec.Containers {
+		if cpu, ok := container.Resources.Requests[corev1.ResourceCPU]; ok {
+			out += cpu.MilliValue()
+		}
+	}
+	return out
+}
@@ -0,0 +1,120 @@
+package k8sreflector
+
+import (
+	"errors"
+	"strings"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// lbPolicies ... the load balancing policies that could be set by the AnnotationLbPolicy,
+// the others need an additional configuration that could not be expressed by an annotation
+var lbPolicies = map[string]int32{
+	clusterv3.Cluster_ROUND_ROBIN.String():   int32(clusterv3.Cluster_ROUND_ROBIN),
+	clusterv3.Cluster_LEAST_REQUEST.String(): int32(clusterv3.Cluster_LEAST_REQUEST),
+	clusterv3.Cluster_RING_HASH.String():     int32(clusterv3.Cluster_RING_HASH),
+	clusterv3.Cluster_RANDOM.String():        int32(clusterv3.Cluster_RANDOM),
+	clusterv3.Cluster_MAGLEV.String():        int32(clusterv3.Cluster_MAGLEV),
+}
+
+// clusterPolicy ... the settings of the clusters of a service that are read from its annotations
+type clusterPolicy struct {
+	lbPolicy        clusterv3.Cluster_LbPolicy
+	connectTimeout  *durationpb.Duration
+	circuitBreakers *clusterv3.CircuitBreakers
+}
+
+// newClusterPolicy ...
+// read the load balancing policy, the connect timeout and the circuit breaker thresholds from the annotations,
+// the invalid values are reported and the clusters are left with their defaults
+func newClusterPolicy(a annotations) clusterPolicy {
+	out := clusterPolicy{
+		lbPolicy:       clusterv3.Cluster_ROUND_ROBIN,
+		connectTimeout: a.duration(AnnotationConnectTimeout),
+	}
+	if lbPolicy, ok := a.enum(AnnotationLbPolicy, lbPolicies); ok {
+		out.lbPolicy = clusterv3.Cluster_LbPolicy(lbPolicy)
+	}
+	thresholds := &clusterv3.CircuitBreakers_Thresholds{
+		Priority:           corev3.RoutingPriority_DEFAULT,
+		MaxRequests:        a.uint32(AnnotationMaxRequests),
+		MaxPendingRequests: a.uint32(AnnotationMaxPendingRequests),
+		MaxRetries:         a.uint32(AnnotationMaxRetries),
+	}
+	if thresholds.MaxRequests != nil || thresholds.MaxPendingRequests != nil || thresholds.MaxRetries != nil {
+		out.circuitBreakers = &clusterv3.CircuitBreakers{
+			Thresholds: []*clusterv3.CircuitBreakers_Thresholds{thresholds},
+		}
+	}
+	return out
+}
+
+func (p clusterPolicy) apply(cds *clusterv3.Cluster) {
+	cds.LbPolicy = p.lbPolicy
+	cds.ConnectTimeout = p.connectTimeout
+	cds.CircuitBreakers = p.circuitBreakers
+}
+
+// retryOnConditions ... the conditions that could be set by the AnnotationRetryOn, the grpc clients only honor the grpc ones
+var retryOnConditions = []string{
+	// grpc
+	"cancelled", "deadline-exceeded", "internal", "resource-exhausted", "unavailable",
+	// http
+	"5xx", "gateway-error", "reset", "reset-before-request", "connect-failure", "envoy-ratelimited",
+	"retriable-4xx", "refused-stream", "retriable-status-codes", "retriable-headers", "http3-post-connect-failure",
+}
+
+// routePolicy ... the settings of the routes of a service that are read from its annotations
+type routePolicy struct {
+	timeout           *durationpb.Duration
+	maxStreamDuration *routev3.RouteAction_MaxStreamDuration
+	retryPolicy       *routev3.RetryPolicy
+}
+
+// newRoutePolicy ...
+// read the timeout, the max stream duration and the retry policy from the annotations,
+// the invalid values are reported and the routes are left with their defaults
+func newRoutePolicy(a annotations) routePolicy {
+	out := routePolicy{
+		timeout: a.duration(AnnotationTimeout),
+	}
+	if maxStreamDuration := a.duration(AnnotationMaxStreamDuration); maxStreamDuration != nil {
+		out.maxStreamDuration = &routev3.RouteAction_MaxStreamDuration{
+			MaxStreamDuration: maxStreamDuration,
+		}
+	}
+	retryOn := a.list(AnnotationRetryOn, retryOnConditions)
+	if len(retryOn) == 0 {
+		return out
+	}
+	out.retryPolicy = &routev3.RetryPolicy{
+		RetryOn:    strings.Join(retryOn, ","),
+		NumRetries: a.uint32(AnnotationNumRetries),
+	}
+	baseInterval := a.duration(AnnotationRetryBackoffBaseInterval)
+	maxInterval := a.duration(AnnotationRetryBackoffMaxInterval)
+	if baseInterval == nil {
+		if maxInterval != nil {
+			a.invalid(AnnotationRetryBackoffMaxInterval, errors.New("requires the base interval"))
+		}
+		return out
+	}
+	if maxInterval != nil && maxInterval.AsDuration() < baseInterval.AsDuration() {
+		a.invalid(AnnotationRetryBackoffMaxInterval, errors.New("must not be less than the base interval"))
+		maxInterval = nil
+	}
+	out.retryPolicy.RetryBackOff = &routev3.RetryPolicy_RetryBackOff{
+		BaseInterval: baseInterval,
+		MaxInterval:  maxInterval,
+	}
+	return out
+}
+
+func (p routePolicy) apply(action *routev3.RouteAction) {
+	action.Timeout = p.timeout
+	action.MaxStreamDuration = p.maxStreamDuration
+	action.RetryPolicy = p.retryPolicy
+}
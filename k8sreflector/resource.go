@@ -3,6 +3,7 @@ package k8sreflector
 import (
 	"cmp"
 	"slices"
+	"strconv"
 
 	"github.com/cespare/xxhash/v2"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
@@ -34,3 +35,26 @@ func resourceHash(resources []types.Resource) (uint64, error) {
 	}
 	return h.Sum64(), nil
 }
+
+// contentVersions ...
+// derive the versions of the pushes of a reflector from the hash of their resources, so that every replica
+// has the same version for the same resources. the versions could be prefixed by the number of the pushes to be ordered,
+// but then they are only consistent within a replica
+type contentVersions struct {
+	monotonic bool
+	pushes    uint64
+}
+
+func newContentVersions(cfg ReflectorConfig) *contentVersions {
+	return &contentVersions{monotonic: cfg.MonotonicVersions}
+}
+
+// version ... the version of the next push of the resources of the hash, the caller must serialize the pushes
+func (v *contentVersions) version(hash uint64) string {
+	v.pushes++
+	version := strconv.FormatUint(hash, 16)
+	if v.monotonic {
+		version = strconv.FormatUint(v.pushes, 10) + "-" + version
+	}
+	return version
+}
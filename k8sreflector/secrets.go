@@ -0,0 +1,135 @@
+package k8sreflector
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/sifer169966/go-xds/reflector"
+	"github.com/sifer169966/go-xds/snapshots"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	k8scache "k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// LabelSDS ... the label that opts a `kubernetes.io/tls` secret in to be served over sds by LabelSDS=true
+const LabelSDS = AnnotationPrefix + "sds"
+
+// SecretValidationContextSuffix ... the suffix of the SecretName of the validation context of the `ca.crt` of a secret
+const SecretValidationContextSuffix = "/ca"
+
+// SecretReflector ...
+// translates the `kubernetes.io/tls` secrets that are labeled by LabelSDS=true into the sds resources, it requires
+// the permission to list and watch the secrets. a secret is served as the tls certificate of its snapshots.SecretName,
+// and its `ca.crt`, if any, is served as the validation context of the name that is suffixed by SecretValidationContextSuffix
+type SecretReflector struct {
+	api  kubernetes.Interface
+	snap snapshots.SnapshotSetter
+	refl *incrementalReflector
+	cfg  ReflectorConfig
+}
+
+// NewSecretReflector ... create a new instance of *SecretReflector
+func NewSecretReflector(c kubernetes.Interface, s snapshots.SnapshotSetter, cfg ReflectorConfig) *SecretReflector {
+	cfg = cfg.defaultConfigure()
+	return &SecretReflector{
+		api:  c,
+		snap: newDebouncedSetter(s, "secrets", cfg),
+		cfg:  cfg,
+	}
+}
+
+// Watch ... run the reflector to watching against k8s API to get the information about secret resources
+func (r *SecretReflector) Watch(ctx context.Context) error {
+	r.refl = newIncrementalReflector(r.cfg.watchNamespaces(), func(namespace string) k8scache.ListerWatcher {
+		return reportListWatchErrors(ctx, &k8scache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				tweakSecretListOptions(r.cfg, &options)
+				return r.api.CoreV1().Secrets(namespace).List(ctx, options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				tweakSecretListOptions(r.cfg, &options)
+				return r.api.CoreV1().Secrets(namespace).Watch(ctx, options)
+			},
+		})
+	}, &corev1.Secret{}, r.cfg.ResyncPeriod, k8scache.Indexers{}, metaNamespaceKeys, func(key string, _ *annotationReports) []types.Resource {
+		return r.translate(ctx, key)
+	}, newContentVersions(r.cfg), func(version string, resources []types.Resource) {
+		r.snap.Set(ctx, version, resources)
+	})
+	klog.Info("starting secrets reflector")
+	err := r.refl.run(ctx, r.cfg.SyncTimeout)
+	if err != nil {
+		return err
+	}
+	klog.Warning("secrets reflector has been stopped")
+	return nil
+}
+
+// tweakSecretListOptions ...
+// only list the tls secrets that are opted in, the selectors of the services are not applied to the secrets
+func tweakSecretListOptions(cfg ReflectorConfig, opts *metav1.ListOptions) {
+	cfg.tweakLookupListOptions(opts, false)
+	opts.LabelSelector = LabelSDS + "=true"
+	opts.FieldSelector = fields.AndSelectors(fields.OneTermEqualSelector("type", string(corev1.SecretTypeTLS)), fields.ParseSelectorOrDie(opts.FieldSelector)).String()
+}
+
+// translate ... translate a secret by its namespace/name key, an invalid secret is reported and served by nothing
+func (r *SecretReflector) translate(ctx context.Context, key string) []types.Resource {
+	obj, ok := r.refl.objects.get(key)
+	if !ok {
+		return nil
+	}
+	out, err := secretToResources(obj.(*corev1.Secret))
+	if err != nil {
+		reflector.ReportError(ctx, fmt.Errorf("invalid tls secret %s: %w", key, err))
+		return nil
+	}
+	return out
+}
+
+// secretToResources ... creating the sds resources of the certificate and the ca of a tls secret
+func secretToResources(secret *corev1.Secret) ([]types.Resource, error) {
+	cert, key := secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey]
+	_, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		return nil, err
+	}
+	name := snapshots.SecretName(secret.Namespace, secret.Name)
+	out := []types.Resource{&tlsv3.Secret{
+		Name: name,
+		Type: &tlsv3.Secret_TlsCertificate{
+			TlsCertificate: &tlsv3.TlsCertificate{
+				CertificateChain: inlineBytes(cert),
+				PrivateKey:       inlineBytes(key),
+			},
+		},
+	}}
+	if ca := secret.Data[corev1.ServiceAccountRootCAKey]; len(ca) > 0 {
+		out = append(out, &tlsv3.Secret{
+			Name: name + SecretValidationContextSuffix,
+			Type: &tlsv3.Secret_ValidationContext{
+				ValidationContext: &tlsv3.CertificateValidationContext{
+					TrustedCa: inlineBytes(ca),
+				},
+			},
+		})
+	}
+	return out, nil
+}
+
+func inlineBytes(b []byte) *corev3.DataSource {
+	return &corev3.DataSource{
+		Specifier: &corev3.DataSource_InlineBytes{
+			InlineBytes: b,
+		},
+	}
+}
@@ -0,0 +1,330 @@
+package k8sreflector
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	listenerv3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	rbacconfigv3 "github.com/envoyproxy/go-control-plane/envoy/config/rbac/v3"
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	rbacv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/rbac/v3"
+	managerv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	matcherv3 "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	"github.com/sifer169966/go-xds/snapshots"
+	"google.golang.org/protobuf/types/known/anypb"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	k8scache "k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// DefaultServerListenerNameTemplate ... the default server_listener_resource_name_template of the grpc xds servers
+const DefaultServerListenerNameTemplate = "grpc/server?xds.resource.listening_address=%s"
+
+var (
+	errInvalidAllowedClient      = errors.New("a client must be <namespace>/<service account>")
+	errAllowedClientsWithoutMTLS = errors.New("the clients are only authenticated by mTLS, the service must be served by mTLS to restrict them")
+)
+
+// ServerListenerReflector ...
+// translates the endpoint slices, or the legacy endpoints, of the services that are annotated by AnnotationServerListeners=true into the inbound listeners
+// of the grpc xds servers of their pods, each pod ip and port gets its own listener that is named by the
+// ServerListenerNameTemplate. the listener requires the client certificates when the service is served by mTLS,
+// and only allows the clients of the AnnotationAllowedClients by the RBAC filter
+type ServerListenerReflector struct {
+	api    kubernetes.Interface
+	snap   snapshots.SnapshotSetter
+	refl   *incrementalReflector
+	lookup lookup
+	cfg    ReflectorConfig
+}
+
+// NewServerListenerReflector ... create a new instance of *ServerListenerReflector
+func NewServerListenerReflector(c kubernetes.Interface, s snapshots.SnapshotSetter, cfg ReflectorConfig) *ServerListenerReflector {
+	cfg = cfg.defaultConfigure()
+	return &ServerListenerReflector{
+		api:  c,
+		snap: newDebouncedSetter(s, "server-listeners", cfg),
+		cfg:  cfg,
+	}
+}
+
+// Watch ... run the reflector to watching against k8s API to get the information about the pods of the grpc xds servers
+func (r *ServerListenerReflector) Watch(ctx context.Context) error {
+	r.lookup = lookup{
+		services: newServiceCache(ctx, r.api, r.cfg, func() {
+			r.refl.repush()
+		}),
+	}
+	push := func(version string, resources []types.Resource) {
+		r.snap.Set(ctx, version, resources)
+	}
+	if r.cfg.EndpointSlices {
+		r.refl = newIncrementalReflector(r.cfg.watchNamespaces(), func(namespace string) k8scache.ListerWatcher {
+			return reportListWatchErrors(ctx, &k8scache.ListWatch{
+				ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+					r.cfg.tweakListOptions(&opts)
+					return r.api.DiscoveryV1().EndpointSlices(namespace).List(ctx, opts)
+				},
+				WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+					r.cfg.tweakListOptions(&opts)
+					return r.api.DiscoveryV1().EndpointSlices(namespace).Watch(ctx, opts)
+				},
+			})
+		}, &discoveryv1.EndpointSlice{}, r.cfg.ResyncPeriod, k8scache.Indexers{serviceIndex: serviceIndexFunc}, endpointSliceServiceKeys, r.translate, newContentVersions(r.cfg), push)
+	} else {
+		r.refl = newIncrementalReflector(r.cfg.watchNamespaces(), func(namespace string) k8scache.ListerWatcher {
+			return reportListWatchErrors(ctx, &k8scache.ListWatch{
+				ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+					r.cfg.tweakListOptions(&opts)
+					return r.api.CoreV1().Endpoints(namespace).List(ctx, opts)
+				},
+				WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+					r.cfg.tweakListOptions(&opts)
+					return r.api.CoreV1().Endpoints(namespace).Watch(ctx, opts)
+				},
+			})
+		}, &corev1.Endpoints{}, r.cfg.ResyncPeriod, k8scache.Indexers{}, metaNamespaceKeys, r.translate, newContentVersions(r.cfg), push)
+	}
+	err := r.lookup.run(ctx, r.cfg.SyncTimeout)
+	if err != nil || ctx.Err() != nil {
+		return err
+	}
+	klog.Info("starting server listeners reflector")
+	err = r.refl.run(ctx, r.cfg.SyncTimeout)
+	if err != nil {
+		return err
+	}
+	klog.Warning("server listeners reflector has been stopped")
+	return nil
+}
+
+// translate ... translate every endpoint slice of a service, or its endpoints, by the namespace/name key of the service
+func (r *ServerListenerReflector) translate(key string, reports *annotationReports) []types.Resource {
+	if !r.cfg.EndpointSlices {
+		obj, ok := r.refl.objects.get(key)
+		if !ok {
+			return nil
+		}
+		return endpointsToServerListeners([]*corev1.Endpoints{obj.(*corev1.Endpoints)}, r.lookup.reporting(reports), r.cfg)
+	}
+	var epss []*discoveryv1.EndpointSlice
+	for _, obj := range r.refl.objects.byIndex(serviceIndex, key) {
+		epss = append(epss, obj.(*discoveryv1.EndpointSlice))
+	}
+	return endpointSlicesToServerListeners(epss, r.lookup.reporting(reports), r.cfg)
+}
+
+// endpointSlicesToServerListeners ...
+// creating the server listeners of every address and port of the endpoint slices of a service, including the ones that are not ready
+// since a grpc xds server does not serve, and so could not become ready, until it has got its listener
+func endpointSlicesToServerListeners(epss []*discoveryv1.EndpointSlice, l lookup, cfg ReflectorConfig) []types.Resource {
+	slices.SortStableFunc(epss, func(a, b *discoveryv1.EndpointSlice) int {
+		return cmp.Or(cmp.Compare(a.Namespace, b.Namespace), cmp.Compare(a.Name, b.Name))
+	})
+	out := []types.Resource{}
+	seen := map[string]struct{}{}
+	for _, eps := range epss {
+		serviceName := eps.Labels[discoveryv1.LabelServiceName]
+		if serviceName == "" || eps.AddressType == discoveryv1.AddressTypeFQDN {
+			continue
+		}
+		annotations := l.serviceAnnotations(eps.Namespace, serviceName)
+		if !annotations.isExported(cfg.RequireOptIn) || !annotations.bool(AnnotationServerListeners, false) {
+			continue
+		}
+		filterChain := newServerFilterChain(annotations, eps.Namespace, cfg)
+		for _, port := range eps.Ports {
+			if port.Port == nil {
+				continue
+			}
+			for _, ep := range eps.Endpoints {
+				if len(ep.Addresses) == 0 {
+					continue
+				}
+				address := net.JoinHostPort(ep.Addresses[0], strconv.Itoa(int(*port.Port)))
+				// an endpoint may be mirrored into more than one slice while it is being moved between them
+				if _, ok := seen[address]; ok {
+					continue
+				}
+				seen[address] = struct{}{}
+				out = append(out, newServerListener(eps.Namespace, ep.Addresses[0], *port.Port, filterChain, cfg))
+			}
+		}
+	}
+	return out
+}
+
+// endpointsToServerListeners ...
+// creating the server listeners of every address and port of the legacy endpoints of a service, including the not ready addresses
+// as endpointSlicesToServerListeners does
+func endpointsToServerListeners(eps []*corev1.Endpoints, l lookup, cfg ReflectorConfig) []types.Resource {
+	out := []types.Resource{}
+	for _, ep := range eps {
+		annotations := l.serviceAnnotations(ep.Namespace, ep.Name)
+		if !annotations.isExported(cfg.RequireOptIn) || !annotations.bool(AnnotationServerListeners, false) {
+			continue
+		}
+		filterChain := newServerFilterChain(annotations, ep.Namespace, cfg)
+		seen := map[string]struct{}{}
+		for _, subset := range ep.Subsets {
+			for _, port := range subset.Ports {
+				for _, addr := range slices.Concat(subset.Addresses, subset.NotReadyAddresses) {
+					address := net.JoinHostPort(addr.IP, strconv.Itoa(int(port.Port)))
+					if _, ok := seen[address]; ok {
+						continue
+					}
+					seen[address] = struct{}{}
+					out = append(out, newServerListener(ep.Namespace, addr.IP, port.Port, filterChain, cfg))
+				}
+			}
+		}
+	}
+	return out
+}
+
+// newServerListener ... the server listener of a pod ip and port
+func newServerListener(namespace, ip string, port int32, filterChain *listenerv3.FilterChain, cfg ReflectorConfig) *listenerv3.Listener {
+	return &listenerv3.Listener{
+		Name:     cfg.serverListenerName(net.JoinHostPort(ip, strconv.Itoa(int(port)))),
+		Metadata: snapshots.NamespaceMetadata(namespace),
+		Address: &corev3.Address{
+			Address: &corev3.Address_SocketAddress{
+				SocketAddress: &corev3.SocketAddress{
+					Protocol: corev3.SocketAddress_TCP,
+					Address:  ip,
+					PortSpecifier: &corev3.SocketAddress_PortValue{
+						PortValue: uint32(port),
+					},
+				},
+			},
+		},
+		FilterChains: []*listenerv3.FilterChain{filterChain},
+	}
+}
+
+// serverListenerName ... the name of the server listener of the ip:port address by the ServerListenerNameTemplate
+func (r ReflectorConfig) serverListenerName(address string) string {
+	return strings.Replace(r.ServerListenerNameTemplate, "%s", address, 1)
+}
+
+// newServerFilterChain ...
+// creating the filter chain of the server listeners of a service, it routes every request to the server itself by the
+// non forwarding action after the RBAC filter, if any, and it is served by mTLS along with the clusters of the service
+func newServerFilterChain(a annotations, namespace string, cfg ReflectorConfig) *listenerv3.FilterChain {
+	mtls := cfg.MTLS.enabledBy(a, namespace)
+	var httpFilters []*managerv3.HttpFilter
+	if rbac := newServerRBAC(a, mtls, cfg.MTLS); rbac != nil {
+		rbacFilter, _ := anypb.New(rbac)
+		httpFilters = append(httpFilters, &managerv3.HttpFilter{
+			Name: wellknown.HTTPRoleBasedAccessControl,
+			ConfigType: &managerv3.HttpFilter_TypedConfig{
+				TypedConfig: rbacFilter,
+			},
+		})
+	}
+	httpFilters = append(httpFilters, &managerv3.HttpFilter{
+		Name: wellknown.Router,
+		ConfigType: &managerv3.HttpFilter_TypedConfig{
+			TypedConfig: routerFilter,
+		},
+	})
+	hcm, _ := anypb.New(&managerv3.HttpConnectionManager{
+		StatPrefix:  "inbound",
+		HttpFilters: httpFilters,
+		RouteSpecifier: &managerv3.HttpConnectionManager_RouteConfig{
+			RouteConfig: &routev3.RouteConfiguration{
+				Name: "inbound",
+				VirtualHosts: []*routev3.VirtualHost{{
+					Name:    "inbound",
+					Domains: []string{"*"},
+					Routes: []*routev3.Route{{
+						Match: &routev3.RouteMatch{
+							PathSpecifier: &routev3.RouteMatch_Prefix{Prefix: "/"},
+						},
+						Action: &routev3.Route_NonForwardingAction{
+							NonForwardingAction: &routev3.NonForwardingAction{},
+						},
+					}},
+				}},
+			},
+		},
+	})
+	out := &listenerv3.FilterChain{
+		Name: "inbound",
+		Filters: []*listenerv3.Filter{{
+			Name: wellknown.HTTPConnectionManager,
+			ConfigType: &listenerv3.Filter_TypedConfig{
+				TypedConfig: hcm,
+			},
+		}},
+	}
+	if mtls {
+		out.TransportSocket = cfg.MTLS.downstreamTransportSocket()
+	}
+	return out
+}
+
+// newServerRBAC ...
+// creating the RBAC filter that only allows the clients of the service accounts of the AnnotationAllowedClients,
+// it is nil if the service is not annotated. the clients are authenticated by their certificates, so the annotation of a server
+// that is not served by mTLS is reported as invalid and ignored
+func newServerRBAC(a annotations, mtls bool, cfg MTLSConfig) *rbacv3.RBAC {
+	clients := a.names(AnnotationAllowedClients)
+	if len(clients) == 0 {
+		return nil
+	}
+	if !mtls {
+		a.invalid(AnnotationAllowedClients, errAllowedClientsWithoutMTLS)
+		return nil
+	}
+	var principals []*rbacconfigv3.Principal
+	for _, client := range clients {
+		namespace, serviceAccount, ok := strings.Cut(client, "/")
+		if !ok || namespace == "" || serviceAccount == "" {
+			a.invalid(AnnotationAllowedClients, errInvalidAllowedClient)
+			continue
+		}
+		matcher := newStringMatcher(false, cfg.spiffeID(namespace, serviceAccount))
+		if serviceAccount == "*" {
+			matcher = &matcherv3.StringMatcher{
+				MatchPattern: &matcherv3.StringMatcher_Prefix{Prefix: cfg.spiffeID(namespace, "")},
+			}
+		}
+		principals = append(principals, &rbacconfigv3.Principal{
+			Identifier: &rbacconfigv3.Principal_Authenticated_{
+				Authenticated: &rbacconfigv3.Principal_Authenticated{
+					PrincipalName: matcher,
+				},
+			},
+		})
+	}
+	out := &rbacv3.RBAC{
+		Rules: &rbacconfigv3.RBAC{
+			Action:   rbacconfigv3.RBAC_ALLOW,
+			Policies: map[string]*rbacconfigv3.Policy{},
+		},
+	}
+	// every request is denied by no policy if none of the clients is valid
+	if len(principals) > 0 {
+		out.Rules.Policies["allowed-clients"] = &rbacconfigv3.Policy{
+			Permissions: []*rbacconfigv3.Permission{{
+				Rule: &rbacconfigv3.Permission_Any{Any: true},
+			}},
+			Principals: principals,
+		}
+	}
+	return out
+}
@@ -3,11 +3,13 @@ package k8sreflector
 import (
 	"context"
 	"fmt"
+	"math"
 	"net"
 	"strconv"
 
 	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
 	listenerv3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
 	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
 	routerv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/router/v3"
@@ -17,7 +19,9 @@ import (
 	"github.com/sifer169966/go-xds/snapshots"
 	"google.golang.org/protobuf/types/known/anypb"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
@@ -26,136 +30,319 @@ import (
 )
 
 type ServiceReflector struct {
-	api        kubernetes.Interface
-	snap       snapshots.SnapshotSetter
-	refl       *k8scache.Reflector
-	localCache localCache
-	cfg        ReflectorConfig
+	api    kubernetes.Interface
+	snap   snapshots.SnapshotSetter
+	refl   *incrementalReflector
+	lookup lookup
+	cfg    ReflectorConfig
 }
 
 // NewServiceReflector ... create a new instance of *ServiceReflector
 func NewServiceReflector(c kubernetes.Interface, s snapshots.SnapshotSetter, cfg ReflectorConfig) *ServiceReflector {
+	cfg = cfg.defaultConfigure()
 	return &ServiceReflector{
 		api:  c,
-		snap: s,
-		cfg:  cfg.defaultConfigure(),
+		snap: newDebouncedSetter(s, "services", cfg),
+		cfg:  cfg,
 	}
 }
 
 // Watch ... run the reflector to watching against k8s API to get the information about service resources
 func (r *ServiceReflector) Watch(ctx context.Context) error {
-	store := k8scache.NewUndeltaStore(r.servicesPushFunc(ctx), k8scache.DeletionHandlingMetaNamespaceKeyFunc)
-	r.refl = k8scache.NewReflector(&k8scache.ListWatch{
-		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
-			return r.api.CoreV1().Services("").List(ctx, options)
-		},
-		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
-			return r.api.CoreV1().Services("").Watch(ctx, options)
-		},
-	}, &corev1.Service{}, store, r.cfg.ResyncPeriod)
+	r.lookup = newServicesLookup(ctx, r.api, r.cfg, func() {
+		r.refl.repush()
+	}, func(oldObj, newObj interface{}) {
+		r.refl.update(r.podServiceKeys(oldObj, newObj))
+	})
+	r.refl = newIncrementalReflector(r.cfg.watchNamespaces(), func(namespace string) k8scache.ListerWatcher {
+		return reportListWatchErrors(ctx, &k8scache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				r.cfg.tweakListOptions(&options)
+				return r.api.CoreV1().Services(namespace).List(ctx, options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				r.cfg.tweakListOptions(&options)
+				return r.api.CoreV1().Services(namespace).Watch(ctx, options)
+			},
+		})
+	}, &corev1.Service{}, r.cfg.ResyncPeriod, k8scache.Indexers{k8scache.NamespaceIndex: k8scache.MetaNamespaceIndexFunc}, metaNamespaceKeys, r.translate, newContentVersions(r.cfg), func(version string, resources []types.Resource) {
+		r.snap.Set(ctx, version, resources)
+	})
+	err := r.lookup.run(ctx, r.cfg.SyncTimeout)
+	if err != nil || ctx.Err() != nil {
+		return err
+	}
 	klog.Info("starting services reflector")
-	r.refl.Run(ctx.Done())
+	err = r.refl.run(ctx, r.cfg.SyncTimeout)
+	if err != nil {
+		return err
+	}
 	klog.Warning("services reflector has been stopped")
 	return nil
 }
 
-func (r *ServiceReflector) servicesPushFunc(ctx context.Context) func(v []interface{}) {
-	return func(v []interface{}) {
-		latestVersion := r.refl.LastSyncResourceVersion()
-		services := sliceToServices(v)
-		resources := servicesToResources(services)
-		resourcesHashed, err := resourceHash(resources)
-		if err == nil {
-			r.localCache.lastResourceHashMutex.Lock()
-			defer r.localCache.lastResourceHashMutex.Unlock()
-			if resourcesHashed == r.localCache.lastResourcesHash {
-				klog.Info("service resources hashed equal with the previous one, no need to update")
-				return
+// translate ... translate a service by its namespace/name key
+func (r *ServiceReflector) translate(key string, reports *annotationReports) []types.Resource {
+	obj, ok := r.refl.objects.get(key)
+	if !ok {
+		return nil
+	}
+	return servicesToResources([]*corev1.Service{obj.(*corev1.Service)}, r.lookup.reporting(reports), r.cfg)
+}
+
+// podServiceKeys ... the namespace/name keys of the services that select the pods
+func (r *ServiceReflector) podServiceKeys(pods ...interface{}) []string {
+	var out []string
+	for _, obj := range pods {
+		pod, ok := obj.(*corev1.Pod)
+		if !ok {
+			continue
+		}
+		for _, svcObj := range r.refl.objects.byIndex(k8scache.NamespaceIndex, pod.Namespace) {
+			svc := svcObj.(*corev1.Service)
+			if len(svc.Spec.Selector) > 0 && labels.SelectorFromSet(svc.Spec.Selector).Matches(labels.Set(pod.Labels)) {
+				out = append(out, svc.Namespace+"/"+svc.Name)
 			}
-			r.localCache.lastResourcesHash = resourcesHashed
-		} else {
-			klog.Error("service resource hash failed", "err", err)
 		}
-		r.snap.Set(ctx, latestVersion, resources)
 	}
+	return out
 }
 
+// routerFilter ... the router http filter of every listener
+var routerFilter, _ = anypb.New(&routerv3.Router{})
+
 // servicesToResources ...
-// creating lds, rds, and cds resources from k8s services
-func servicesToResources(svcs []*corev1.Service) []types.Resource {
+// creating lds, rds, and cds resources from k8s services, the services that are not exported are skipped.
+// the cluster and route policies of each service are read from its annotations.
+// each pod of a headless service gets its own resources to be addressed individually by <pod>.<service>.<namespace>
+func servicesToResources(svcs []*corev1.Service, l lookup, cfg ReflectorConfig) []types.Resource {
 	out := []types.Resource{}
-	router, _ := anypb.New(&routerv3.Router{})
 	for _, svc := range svcs {
+		annotations := l.annotations(svc)
+		if !annotations.isExported(cfg.RequireOptIn) {
+			continue
+		}
+		clusterPolicy := newClusterPolicy(annotations)
+		routePolicy := newRoutePolicy(annotations)
+		tlsPolicy := newMTLSPolicy(annotations, svc, l, cfg.MTLS)
 		host := fmt.Sprintf("%s.%s", svc.Name, svc.Namespace)
-		for _, port := range svc.Spec.Ports {
-			hostWithPortName := net.JoinHostPort(host, port.Name)
-			hostWithPortNumber := net.JoinHostPort(host, strconv.Itoa(int(port.Port)))
-			rds := &routev3.RouteConfiguration{
-				Name: hostWithPortNumber,
-				VirtualHosts: []*routev3.VirtualHost{
-					{
-						Name:    hostWithPortName,
-						Domains: []string{host, hostWithPortName, hostWithPortNumber, svc.Name},
-						Routes: []*routev3.Route{{
-							Name: "default",
-							Match: &routev3.RouteMatch{
-								PathSpecifier: &routev3.RouteMatch_Prefix{},
-							},
-							Action: &routev3.Route_Route{
-								Route: &routev3.RouteAction{
-									ClusterSpecifier: &routev3.RouteAction_Cluster{
-										Cluster: hostWithPortName,
-									},
-								},
-							},
-						}},
-					},
-				},
+		var podNames []string
+		if isHeadless(svc) {
+			podNames = l.headlessPodNames(svc.Namespace, svc.Name)
+		}
+		ports := svc.Spec.Ports
+		if svc.Spec.Type == corev1.ServiceTypeExternalName && len(ports) == 0 {
+			ports = externalNamePorts(annotations)
+		}
+		for _, port := range ports {
+			clusterName := cfg.clusterName(svc.Namespace, svc.Name, port)
+			var cds *clusterv3.Cluster
+			if svc.Spec.Type == corev1.ServiceTypeExternalName {
+				cds = newDNSCluster(clusterName, port, svc.Spec.ExternalName, annotations)
+			} else {
+				cds = newEDSCluster(clusterName)
+			}
+			cds.Metadata = snapshots.NamespaceMetadata(svc.Namespace)
+			clusterPolicy.apply(cds)
+			tlsPolicy.apply(cds)
+			out = append(out, newRouteResources(svc.Namespace, host, port, []string{svc.Name}, cds.Name, routePolicy)...)
+			out = append(out, cds)
+			for _, podName := range podNames {
+				podHost := fmt.Sprintf("%s.%s", podName, host)
+				podCds := newEDSCluster(headlessClusterName(podName, clusterName))
+				podCds.Metadata = snapshots.NamespaceMetadata(svc.Namespace)
+				clusterPolicy.apply(podCds)
+				tlsPolicy.apply(podCds)
+				out = append(out, newRouteResources(svc.Namespace, podHost, port, nil, podCds.Name, routePolicy)...)
+				out = append(out, podCds)
 			}
+		}
+	}
+	return out
+}
 
-			hcm, _ := anypb.New(&managerv3.HttpConnectionManager{
-				HttpFilters: []*managerv3.HttpFilter{
-					{
-						Name: wellknown.Router,
-						ConfigType: &managerv3.HttpFilter_TypedConfig{
-							TypedConfig: router,
-						},
-					},
-				},
-				RouteSpecifier: &managerv3.HttpConnectionManager_RouteConfig{
-					RouteConfig: rds,
+// externalNamePorts ...
+// the port of an ExternalName service that has no ports by the AnnotationExternalNamePort,
+// the service is reported and it has no port, so it is not translated, without the annotation
+func externalNamePorts(a annotations) []corev1.ServicePort {
+	port := a.uint32(AnnotationExternalNamePort)
+	if port == nil {
+		if _, ok := a.values[AnnotationExternalNamePort]; !ok {
+			a.invalid(AnnotationExternalNamePort, errMissingExternalNamePort)
+		}
+		return nil
+	}
+	if port.Value > math.MaxUint16 {
+		a.invalid(AnnotationExternalNamePort, errInvalidPort)
+		return nil
+	}
+	return []corev1.ServicePort{{Protocol: corev1.ProtocolTCP, Port: int32(port.Value)}}
+}
+
+// newRouteResources ...
+// creating the lds and rds resources that route the requests to the host and port of a service into the cluster
+func newRouteResources(namespace string, host string, port corev1.ServicePort, aliases []string, clusterName string, policy routePolicy) []types.Resource {
+	action := &routev3.RouteAction{
+		ClusterSpecifier: &routev3.RouteAction_Cluster{
+			Cluster: clusterName,
+		},
+	}
+	policy.apply(action)
+	return newVirtualHostResources(namespace, host, port, aliases, []*routev3.Route{{
+		Name: "default",
+		Match: &routev3.RouteMatch{
+			PathSpecifier: &routev3.RouteMatch_Prefix{},
+		},
+		Action: &routev3.Route_Route{
+			Route: action,
+		},
+	}})
+}
+
+// newVirtualHostResources ...
+// creating the lds and rds resources of the host and port of a service that have a single virtual host of the routes,
+// they are named by the host and port number so that the resources of the same service port override each other,
+// and the listener is tagged by the namespace of the service
+func newVirtualHostResources(namespace string, host string, port corev1.ServicePort, aliases []string, routes []*routev3.Route) []types.Resource {
+	hostWithPortName := net.JoinHostPort(host, port.Name)
+	hostWithPortNumber := net.JoinHostPort(host, strconv.Itoa(int(port.Port)))
+	rds := &routev3.RouteConfiguration{
+		Name: hostWithPortNumber,
+		VirtualHosts: []*routev3.VirtualHost{
+			{
+				Name:    hostWithPortName,
+				Domains: append([]string{host, hostWithPortName, hostWithPortNumber}, aliases...),
+				Routes:  routes,
+			},
+		},
+	}
+
+	hcm, _ := anypb.New(&managerv3.HttpConnectionManager{
+		HttpFilters: []*managerv3.HttpFilter{
+			{
+				Name: wellknown.Router,
+				ConfigType: &managerv3.HttpFilter_TypedConfig{
+					TypedConfig: routerFilter,
 				},
-			})
+			},
+		},
+		RouteSpecifier: &managerv3.HttpConnectionManager_RouteConfig{
+			RouteConfig: rds,
+		},
+	})
 
-			lds := &listenerv3.Listener{
-				Name: hostWithPortNumber,
-				ApiListener: &listenerv3.ApiListener{
-					ApiListener: hcm,
+	lds := &listenerv3.Listener{
+		Name:     hostWithPortNumber,
+		Metadata: snapshots.NamespaceMetadata(namespace),
+		ApiListener: &listenerv3.ApiListener{
+			ApiListener: hcm,
+		},
+	}
+	return []types.Resource{lds, rds}
+}
+
+// newEDSCluster ... creating a cds resource of which endpoints are discovered by the eds
+func newEDSCluster(name string) *clusterv3.Cluster {
+	return &clusterv3.Cluster{
+		Name:                 name,
+		ClusterDiscoveryType: &clusterv3.Cluster_Type{Type: clusterv3.Cluster_EDS},
+		LbPolicy:             clusterv3.Cluster_ROUND_ROBIN,
+		EdsClusterConfig: &clusterv3.Cluster_EdsClusterConfig{
+			EdsConfig: &corev3.ConfigSource{
+				ConfigSourceSpecifier: &corev3.ConfigSource_Ads{
+					Ads: &corev3.AggregatedConfigSource{},
 				},
-			}
+			},
+		},
+	}
+}
 
-			cds := &clusterv3.Cluster{
-				Name:                 hostWithPortName,
-				ClusterDiscoveryType: &clusterv3.Cluster_Type{Type: clusterv3.Cluster_EDS},
-				LbPolicy:             clusterv3.Cluster_ROUND_ROBIN,
-				EdsClusterConfig: &clusterv3.Cluster_EdsClusterConfig{
-					EdsConfig: &corev3.ConfigSource{
-						ConfigSourceSpecifier: &corev3.ConfigSource_Ads{
-							Ads: &corev3.AggregatedConfigSource{},
+// dnsClusterTypes ... the cluster types that could be set by the AnnotationDNSClusterType
+var dnsClusterTypes = map[string]int32{
+	clusterv3.Cluster_LOGICAL_DNS.String(): int32(clusterv3.Cluster_LOGICAL_DNS),
+	clusterv3.Cluster_STRICT_DNS.String():  int32(clusterv3.Cluster_STRICT_DNS),
+}
+
+// newDNSCluster ...
+// creating a cds resource that resolves the external name of an ExternalName service by the dns,
+// it is LOGICAL_DNS by default since it is the one that is supported by the grpc clients
+func newDNSCluster(name string, port corev1.ServicePort, externalName string, a annotations) *clusterv3.Cluster {
+	clusterType := clusterv3.Cluster_LOGICAL_DNS
+	if v, ok := a.enum(AnnotationDNSClusterType, dnsClusterTypes); ok {
+		clusterType = clusterv3.Cluster_DiscoveryType(v)
+	}
+	return &clusterv3.Cluster{
+		Name:                 name,
+		ClusterDiscoveryType: &clusterv3.Cluster_Type{Type: clusterType},
+		LbPolicy:             clusterv3.Cluster_ROUND_ROBIN,
+		LoadAssignment: &endpointv3.ClusterLoadAssignment{
+			ClusterName: name,
+			Endpoints: []*endpointv3.LocalityLbEndpoints{{
+				LbEndpoints: []*endpointv3.LbEndpoint{{
+					HostIdentifier: &endpointv3.LbEndpoint_Endpoint{
+						Endpoint: &endpointv3.Endpoint{
+							Address: &corev3.Address{
+								Address: &corev3.Address_SocketAddress{
+									SocketAddress: &corev3.SocketAddress{
+										Protocol: corev3.SocketAddress_TCP,
+										Address:  externalName,
+										PortSpecifier: &corev3.SocketAddress_PortValue{
+											PortValue: uint32(port.Port),
+										},
+									},
+								},
+							},
 						},
 					},
-				},
-			}
-			out = append(out, lds, rds, cds)
-		}
+				}},
+			}},
+		},
 	}
-	return out
 }
 
-func sliceToServices(services []interface{}) []*corev1.Service {
-	out := make([]*corev1.Service, len(services))
-	for i, svc := range services {
-		out[i] = svc.(*corev1.Service)
-	}
-	return out
+func isHeadless(svc *corev1.Service) bool {
+	return svc.Spec.Type != corev1.ServiceTypeExternalName && svc.Spec.ClusterIP == corev1.ClusterIPNone
+}
+
+// newServiceCache ...
+// create a cache of the services to read the annotations and the ports of the services while translating the other objects
+func newServiceCache(ctx context.Context, api kubernetes.Interface, cfg ReflectorConfig, onChange func()) *objectCache {
+	return newObjectCache(cfg.watchNamespaces(), func(namespace string) k8scache.ListerWatcher {
+		return reportListWatchErrors(ctx, &k8scache.ListWatch{
+			ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+				cfg.tweakLookupListOptions(&opts, true)
+				return api.CoreV1().Services(namespace).List(ctx, opts)
+			},
+			WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+				cfg.tweakLookupListOptions(&opts, true)
+				return api.CoreV1().Services(namespace).Watch(ctx, opts)
+			},
+		})
+	}, &corev1.Service{}, cfg.ResyncPeriod, k8scache.Indexers{}, func(obj interface{}) (interface{}, error) {
+		svc, ok := obj.(*corev1.Service)
+		if !ok {
+			return obj, nil
+		}
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            svc.Name,
+				Namespace:       svc.Namespace,
+				Annotations:     xdsAnnotations(svc.Annotations),
+				ResourceVersion: svc.ResourceVersion,
+			},
+			Spec: corev1.ServiceSpec{
+				Type:      svc.Spec.Type,
+				ClusterIP: svc.Spec.ClusterIP,
+				Ports:     svc.Spec.Ports,
+			},
+		}, nil
+	}, func(oldObj, newObj interface{}) bool {
+		oldSvc, _ := oldObj.(*corev1.Service)
+		newSvc, _ := newObj.(*corev1.Service)
+		// the ports are looked up to name the clusters and to resolve the gateway routes
+		if oldSvc == nil || newSvc == nil {
+			return true
+		}
+		return xdsAnnotationsChanged(oldSvc.Annotations, newSvc.Annotations) || !equality.Semantic.DeepEqual(oldSvc.Spec.Ports, newSvc.Spec.Ports)
+	}, onAnyChange(onChange))
 }
@@ -14,10 +14,12 @@ import (
 	xds "github.com/envoyproxy/go-control-plane/pkg/server/v3"
 	"github.com/sifer169966/go-xds/callbacks"
 	"github.com/sifer169966/go-xds/configs"
+	"github.com/sifer169966/go-xds/filereflector"
 	"github.com/sifer169966/go-xds/k8sreflector"
 	"github.com/sifer169966/go-xds/metrics"
 	"github.com/sifer169966/go-xds/monitor"
 	"github.com/sifer169966/go-xds/reflector"
+	"github.com/sifer169966/go-xds/servertls"
 	"github.com/sifer169966/go-xds/snapshots"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/health"
@@ -25,6 +27,7 @@ import (
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog/v2"
+	gatewayclient "sigs.k8s.io/gateway-api/pkg/client/clientset/versioned"
 )
 
 func main() {
@@ -48,9 +51,124 @@ func main() {
 		klog.Fatal("could not create k8s client", "err", err)
 	}
 
-	snap := snapshots.New()
-	endpointReflector := k8sreflector.NewEndpointReflector(k8sClient, snap, k8sreflector.ReflectorConfig{})
-	serviceReflector := k8sreflector.NewServiceReflector(k8sClient, snap, k8sreflector.ReflectorConfig{})
+	nodeHash, err := snapshots.NewNodeHash(cfg.Snapshot.NodeHash, cfg.Snapshot.NodeHashMetadataKey)
+	if err != nil {
+		klog.Fatal("invalid snapshot configuration", "err", err)
+	}
+	snapCfg := snapshots.Config{
+		NodeHash:       nodeHash,
+		LinearClusters: cfg.Snapshot.LinearClusters,
+		GroupIdleTTL:   cfg.Snapshot.GroupIdleTTL,
+		PersistDir:     cfg.Snapshot.PersistDir,
+		PersistMaxAge:  cfg.Snapshot.PersistMaxAge,
+	}
+	// groupNamespaces resolves the namespaces that each group sees for the authorization, nil if every group sees every namespace
+	var groupNamespaces func(group string) []string
+	if cfg.Snapshot.NamespaceIsolation {
+		filter := snapshots.NamespaceFilter{
+			Shared: cfg.Snapshot.SharedNamespaces,
+			Groups: cfg.Snapshot.GroupNamespaces,
+		}
+		snapCfg.Filter = filter
+		groupNamespaces = filter.Namespaces
+	}
+	snap := snapshots.New(snapCfg)
+	reflectorCfg := k8sreflector.ReflectorConfig{
+		ResyncPeriod:               cfg.Reflector.ResyncPeriod,
+		EndpointSlices:             cfg.Reflector.EndpointsAPI == "endpointslices",
+		TopologyFromNodes:          cfg.Reflector.TopologyFromNodes,
+		WatchPods:                  cfg.Reflector.WatchPods,
+		WeightFromCPURequests:      cfg.Reflector.WeightFromCPURequests,
+		Namespaces:                 cfg.Reflector.Namespaces,
+		ExcludedNamespaces:         cfg.Reflector.ExcludedNamespaces,
+		LabelSelector:              cfg.Reflector.LabelSelector,
+		FieldSelector:              cfg.Reflector.FieldSelector,
+		RequireOptIn:               cfg.Reflector.RequireOptIn,
+		ClusterNameTemplate:        cfg.Reflector.ClusterNameTemplate,
+		DebounceWindow:             cfg.Reflector.DebounceWindow,
+		DebounceMaxDelay:           cfg.Reflector.DebounceMaxDelay,
+		SyncTimeout:                cfg.Reflector.SyncTimeout,
+		MonotonicVersions:          cfg.Reflector.MonotonicVersions,
+		ServerListenerNameTemplate: cfg.Reflector.ServerListenerNameTemplate,
+		MTLS: k8sreflector.MTLSConfig{
+			Namespaces:           cfg.Reflector.MTLSNamespaces,
+			CertProviderInstance: cfg.Reflector.MTLSCertProviderInstance,
+			CAProviderInstance:   cfg.Reflector.MTLSCAProviderInstance,
+			TrustDomain:          cfg.Reflector.MTLSTrustDomain,
+		},
+	}
+	err = reflectorCfg.Validate()
+	if err != nil {
+		klog.Fatal("invalid reflector configuration", "err", err)
+	}
+	// the server is not ready until every reflector of the local sources has published its first snapshot
+	readiness := reflector.NewReadiness()
+	// a failed reflector is restarted without tearing down the others
+	supervisor := reflector.NewSupervisor(reflector.SupervisorConfig{
+		InitialBackoff: cfg.Reflector.RestartInitialBackoff,
+		MaxBackoff:     cfg.Reflector.RestartMaxBackoff,
+		MaxFailures:    cfg.Reflector.RestartMaxFailures,
+	})
+	supervisor.Add("services", k8sreflector.NewServiceReflector(k8sClient, readiness.Track("services", snap.Source("services", 0)), reflectorCfg))
+	if len(cfg.Reflector.RemoteClusters) == 0 {
+		supervisor.Add("endpoints", newEndpointReflector(cfg.Reflector, k8sClient, k8sClient, readiness.Track("endpoints", snap.Source("endpoints", 0)), reflectorCfg))
+	} else {
+		// the endpoints of every k8s cluster are merged into the clusters of the local services
+		aggregator := snapshots.NewLoadAssignmentAggregator(snap.Source("endpoints", 0))
+		localName := "endpoints/" + cfg.Reflector.LocalClusterName
+		supervisor.Add(localName, newEndpointReflector(cfg.Reflector, k8sClient, k8sClient, readiness.Track(localName, aggregator.Member(cfg.Reflector.LocalClusterName, cfg.Reflector.LocalClusterPriority)), reflectorCfg))
+		clusterNames := map[string]bool{cfg.Reflector.LocalClusterName: true}
+		for _, remote := range cfg.Reflector.RemoteClusters {
+			if clusterNames[remote.Name] {
+				klog.Fatal("duplicated k8s cluster name", "cluster", remote.Name)
+			}
+			clusterNames[remote.Name] = true
+			loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+			if remote.Kubeconfig != "" {
+				loadingRules = &clientcmd.ClientConfigLoadingRules{ExplicitPath: remote.Kubeconfig}
+			}
+			remoteClientConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{CurrentContext: remote.Context}).ClientConfig()
+			if err != nil {
+				klog.Fatal("could not create k8s client configuration of the remote cluster", "cluster", remote.Name, "err", err)
+			}
+			remoteClient, err := kubernetes.NewForConfig(remoteClientConfig)
+			if err != nil {
+				klog.Fatal("could not create k8s client of the remote cluster", "cluster", remote.Name, "err", err)
+			}
+			remoteName := "endpoints/" + remote.Name
+			// the services of the remote endpoints are the local ones, which the clusters and their policies are translated from.
+			// the readiness does not wait for the remote clusters, so that an unreachable one does not keep the server from serving the others
+			supervisor.Add(remoteName, newEndpointReflector(cfg.Reflector, remoteClient, k8sClient, aggregator.Member(remote.Name, remote.Priority), reflectorCfg))
+		}
+	}
+	if cfg.Reflector.GatewayRoutes {
+		gatewayClient, err := gatewayclient.NewForConfig(k8sClientConfig)
+		if err != nil {
+			klog.Fatal("could not create gateway API client", "err", err)
+		}
+		// the routes of the gateway API override the default routes of the services
+		supervisor.Add("gateway-routes", k8sreflector.NewGatewayRouteReflector(k8sClient, gatewayClient, readiness.Track("gateway-routes", snap.Source("gateway-routes", 1)), reflectorCfg))
+	}
+	if cfg.Reflector.ServerListeners {
+		supervisor.Add("server-listeners", k8sreflector.NewServerListenerReflector(k8sClient, readiness.Track("server-listeners", snap.Source("server-listeners", 0)), reflectorCfg))
+	}
+	if cfg.Reflector.Secrets {
+		// the private keys would be served to any client that asks for their names
+		if !cfg.Snapshot.NamespaceIsolation && cfg.Authz.PolicyFile == "" {
+			klog.Fatal("the secrets reflector requires either SNAPSHOT_NAMESPACE_ISOLATION or AUTHZ_POLICY_FILE to restrict the clients that get the private keys")
+		}
+		if cfg.ServerTLS.CertFile == "" {
+			klog.Warning("the secrets reflector serves the private keys over a plaintext xds server, set SERVER_TLS_CERT_FILE to encrypt them")
+		}
+		supervisor.Add("secrets", k8sreflector.NewSecretReflector(k8sClient, readiness.Track("secrets", snap.Source("secrets", 0)), reflectorCfg))
+	}
+	if cfg.Reflector.StaticResourcesDir != "" {
+		// the hand-written resources override the ones of the k8s reflectors
+		supervisor.Add("files", filereflector.NewFileReflector(readiness.Track("files", snap.Source("files", 2)), filereflector.Config{
+			Dir:          cfg.Reflector.StaticResourcesDir,
+			PollInterval: cfg.Reflector.StaticResourcesPollInterval,
+		}))
+	}
 
 	stopCtx, stop := context.WithCancel(context.Background())
 
@@ -62,17 +180,44 @@ func main() {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		err := reflector.Start(stopCtx, endpointReflector, serviceReflector)
+		err := supervisor.Run(stopCtx)
 		if err != nil {
 			klog.Error("error while running the reflector", "err", err)
 		}
 		stopCh <- true
 	}()
 
-	grpcServer := grpc.NewServer()
+	var serverOpts []grpc.ServerOption
+	if cfg.ServerTLS.CertFile != "" {
+		tlsReloader, err := servertls.NewReloader(servertls.Config{
+			CertFile:          cfg.ServerTLS.CertFile,
+			KeyFile:           cfg.ServerTLS.KeyFile,
+			ClientCAFile:      cfg.ServerTLS.ClientCAFile,
+			RequireClientCert: cfg.ServerTLS.RequireClientCert,
+			ReloadInterval:    cfg.ServerTLS.ReloadInterval,
+		})
+		if err != nil {
+			klog.Fatal("invalid server tls configuration", "err", err)
+		}
+		// the rotated files are used by the new connections without dropping the established streams
+		go tlsReloader.Run(stopCtx)
+		serverOpts = append(serverOpts, grpc.Creds(tlsReloader.Credentials()))
+	} else {
+		klog.Warning("the xds server has no tls certificate, the resources are served in plaintext")
+	}
+	grpcServer := grpc.NewServer(serverOpts...)
 	healthServer := health.NewServer()
-	monitorServer := monitor.NewREST(snap.MuxCache(), cfg.MonitorServer)
-	xdsServer := xds.NewServer(stopCtx, snap.MuxCache(), callbacks.New())
+	healthServer.SetServingStatus("", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	monitorServer := monitor.NewREST(snap.MuxCache(), readiness, supervisor, cfg.MonitorServer)
+	var authz *callbacks.Authorizer
+	if cfg.Authz.PolicyFile != "" {
+		policy, err := callbacks.LoadAuthzPolicy(cfg.Authz.PolicyFile)
+		if err != nil {
+			klog.Fatal("invalid authorization policy", "err", err)
+		}
+		authz = callbacks.NewAuthorizer(policy, nodeHash, groupNamespaces)
+	}
+	xdsServer := xds.NewServer(stopCtx, snap.MuxCache(), callbacks.New(authz))
 	grpc_health_v1.RegisterHealthServer(grpcServer, healthServer)
 	discoverygrpc.RegisterAggregatedDiscoveryServiceServer(grpcServer, xdsServer)
 
@@ -110,8 +255,32 @@ func main() {
 		}
 	}()
 
+	go func() {
+		select {
+		case <-readiness.Done():
+			klog.Info("every reflector has published its snapshot, the server is ready")
+			healthServer.SetServingStatus("", grpc_health_v1.HealthCheckResponse_SERVING)
+		case <-stopCtx.Done():
+		}
+	}()
+
 	go monitorServer.ListenAndServe()
 	klog.Info(fmt.Sprintln("starting server at port", listenPort))
 	wg.Wait()
 	klog.Info("application was closed")
 }
+
+// newEndpointReflector ...
+// create the reflector of the endpoints of a k8s cluster by the configured endpoints API,
+// the services of the endpoints are resolved from the serviceClient
+func newEndpointReflector(cfg configs.Reflector, c kubernetes.Interface, serviceClient kubernetes.Interface, s snapshots.SnapshotSetter, reflectorCfg k8sreflector.ReflectorConfig) reflector.Reflector {
+	switch cfg.EndpointsAPI {
+	case "endpointslices":
+		return k8sreflector.NewEndpointSliceReflector(c, s, reflectorCfg).WithServicesFrom(serviceClient)
+	case "endpoints":
+		return k8sreflector.NewEndpointReflector(c, s, reflectorCfg).WithServicesFrom(serviceClient)
+	default:
+		klog.Fatal("unknown endpoints API", "endpointsAPI", cfg.EndpointsAPI)
+		return nil
+	}
+}
@@ -11,6 +11,11 @@ import (
 var (
 	ResourceKindAttrKey attribute.Key = "resource_kind"
 	TypeURLAttrKey      attribute.Key = "type_url"
+	AnnotationAttrKey   attribute.Key = "annotation"
+	SourceAttrKey       attribute.Key = "source"
+	ReflectorAttrKey    attribute.Key = "reflector"
+	StateAttrKey        attribute.Key = "state"
+	ReasonAttrKey       attribute.Key = "reason"
 )
 
 // GetGlobalMeter ... get the global meter from otel library
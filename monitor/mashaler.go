@@ -3,18 +3,27 @@ package monitor
 import (
 	"encoding/json"
 
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
 	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
 	resourcev3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
 	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
 )
 
 type cacheMarshaler struct {
 	cachev3.Cache
 }
 
+// snapshotGetter ... the caches of which snapshot of each node could be inspected, e.g. cachev3.SnapshotCache
+type snapshotGetter interface {
+	GetStatusKeys() []string
+	GetSnapshot(node string) (cachev3.ResourceSnapshot, error)
+}
+
 func (c cacheMarshaler) MarshalJSON() ([]byte, error) {
-	snapshotCache, ok := c.Cache.(cachev3.SnapshotCache)
+	snapshotCache, ok := c.Cache.(snapshotGetter)
 	if !ok {
 		return nil, nil
 	}
@@ -73,5 +82,23 @@ type resourceMarshaler struct {
 }
 
 func (r resourceMarshaler) MarshalJSON() ([]byte, error) {
+	if secret, ok := r.Resource.(*tlsv3.Secret); ok {
+		return protojson.Marshal(redactSecret(secret))
+	}
 	return protojson.Marshal(r.Resource)
 }
+
+// redacted ... the data source that replaces the private parts of the secrets to not expose them by the monitor
+var redacted = &corev3.DataSource{Specifier: &corev3.DataSource_InlineString{InlineString: "[redacted]"}}
+
+// redactSecret ... a copy of the secret without its private key and generic secret, the certificates are kept to be inspected
+func redactSecret(secret *tlsv3.Secret) *tlsv3.Secret {
+	out := proto.Clone(secret).(*tlsv3.Secret)
+	if cert := out.GetTlsCertificate(); cert.GetPrivateKey() != nil {
+		cert.PrivateKey = redacted
+	}
+	if generic := out.GetGenericSecret(); generic.GetSecret() != nil {
+		generic.Secret = redacted
+	}
+	return out
+}
@@ -9,15 +9,18 @@ import (
 	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sifer169966/go-xds/configs"
+	"github.com/sifer169966/go-xds/reflector"
 )
 
 type RESTServer struct {
 	http.Server
-	mux      *http.ServeMux
-	muxCache *cachev3.MuxCache
+	mux        *http.ServeMux
+	muxCache   *cachev3.MuxCache
+	readiness  *reflector.Readiness
+	supervisor *reflector.Supervisor
 }
 
-func NewREST(muxCache *cachev3.MuxCache, cfg configs.MonitorServer) *RESTServer {
+func NewREST(muxCache *cachev3.MuxCache, readiness *reflector.Readiness, supervisor *reflector.Supervisor, cfg configs.MonitorServer) *RESTServer {
 	mux := http.NewServeMux()
 	out := &RESTServer{
 		mux: mux,
@@ -26,7 +29,9 @@ func NewREST(muxCache *cachev3.MuxCache, cfg configs.MonitorServer) *RESTServer
 			Handler:           mux,
 			ReadHeaderTimeout: cfg.ReadHeaderTimeout,
 		},
-		muxCache: muxCache,
+		muxCache:   muxCache,
+		readiness:  readiness,
+		supervisor: supervisor,
 	}
 
 	out.resgisterRoutes()
@@ -37,6 +42,8 @@ func (s *RESTServer) resgisterRoutes() {
 	s.mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("ok"))
 	})
+	s.mux.HandleFunc("/readyz", s.retrieveReadiness)
+	s.mux.HandleFunc("/reflectors", s.retrieveReflectors)
 	s.mux.HandleFunc("/", s.retrieveSnapshotInfo)
 
 	s.mux.Handle("/metrics", promhttp.Handler())
@@ -59,3 +66,29 @@ func (s *RESTServer) retrieveSnapshotInfo(w http.ResponseWriter, _ *http.Request
 	w.Header().Set("Content-Type", "application/json")
 	enc.Encode(out)
 }
+
+// retrieveReadiness ... respond the status of each reflector, the status code is 503 until every reflector is ready
+func (s *RESTServer) retrieveReadiness(w http.ResponseWriter, _ *http.Request) {
+	out := struct {
+		Ready      bool                                 `json:"ready"`
+		Reflectors map[string]reflector.ReflectorStatus `json:"reflectors"`
+	}{
+		Ready:      s.readiness.Ready(),
+		Reflectors: s.readiness.Statuses(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !out.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(out)
+}
+
+// retrieveReflectors ... respond the supervised status of each reflector, e.g. its state and its latest error
+func (s *RESTServer) retrieveReflectors(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(s.supervisor.Statuses())
+}
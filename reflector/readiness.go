@@ -0,0 +1,101 @@
+package reflector
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/sifer169966/go-xds/snapshots"
+)
+
+// Readiness ...
+// tracks whether every reflector has published its first snapshot, the reflectors only publish once they have listed
+// every object, so the server is not ready to serve until then
+type Readiness struct {
+	// mu guards the statuses
+	mu       sync.Mutex
+	statuses map[string]*ReflectorStatus
+	ready    chan struct{}
+}
+
+// ReflectorStatus ... the readiness of a reflector and its latest snapshot
+type ReflectorStatus struct {
+	Ready         bool      `json:"ready"`
+	Version       string    `json:"version,omitempty"`
+	LastPublished time.Time `json:"lastPublished,omitempty"`
+}
+
+// NewReadiness ... create a new instance of *Readiness that is not ready until the reflectors that it tracks are
+func NewReadiness() *Readiness {
+	return &Readiness{
+		statuses: map[string]*ReflectorStatus{},
+		ready:    make(chan struct{}),
+	}
+}
+
+// Track ... register the reflector of the name and wrap the snapshot setter that it publishes into to be notified of its snapshots
+func (r *Readiness) Track(name string, s snapshots.SnapshotSetter) snapshots.SnapshotSetter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.statuses[name] = &ReflectorStatus{}
+	return &readinessSetter{readiness: r, name: name, snap: s}
+}
+
+// Ready ... whether every reflector has published its first snapshot
+func (r *Readiness) Ready() bool {
+	select {
+	case <-r.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// Done ... the channel that is closed once every reflector has published its first snapshot
+func (r *Readiness) Done() <-chan struct{} {
+	return r.ready
+}
+
+// Statuses ... the status of each reflector
+func (r *Readiness) Statuses() map[string]ReflectorStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make(map[string]ReflectorStatus, len(r.statuses))
+	for name, status := range r.statuses {
+		out[name] = *status
+	}
+	return out
+}
+
+// published ... record the snapshot of the reflector and close the ready channel if it was the last one to be ready
+func (r *Readiness) published(name string, version string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := r.statuses[name]
+	status.Ready = true
+	status.Version = version
+	status.LastPublished = time.Now()
+	if r.Ready() {
+		return
+	}
+	for _, status := range r.statuses {
+		if !status.Ready {
+			return
+		}
+	}
+	close(r.ready)
+}
+
+// readinessSetter ... a snapshot setter that notifies the Readiness of each snapshot of the reflector
+type readinessSetter struct {
+	readiness *Readiness
+	name      string
+	snap      snapshots.SnapshotSetter
+}
+
+// Set ...
+func (s *readinessSetter) Set(ctx context.Context, version string, src []types.Resource) {
+	s.snap.Set(ctx, version, src)
+	s.readiness.published(s.name, version)
+}
@@ -0,0 +1,27 @@
+package reflector
+
+import (
+	"context"
+
+	"k8s.io/klog/v2"
+)
+
+// errorReporterKey ... the context key of the function that reports the errors of the reflector that runs by the context
+type errorReporterKey struct{}
+
+// withErrorReporter ... carry the report function of a reflector by the ctx that it runs by
+func withErrorReporter(ctx context.Context, report func(err error)) context.Context {
+	return context.WithValue(ctx, errorReporterKey{}, report)
+}
+
+// ReportError ...
+// report an error that the reflector of the ctx recovers from by itself, e.g. a failed list or watch that is retried,
+// to the Supervisor that runs it. the error is only logged if the reflector is not run by a Supervisor
+func ReportError(ctx context.Context, err error) {
+	report, ok := ctx.Value(errorReporterKey{}).(func(err error))
+	if !ok {
+		klog.Error("reflector error", "err", err)
+		return
+	}
+	report(err)
+}
@@ -0,0 +1,211 @@
+package reflector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sifer169966/go-xds/metrics"
+	otelmetric "go.opentelemetry.io/otel/metric"
+	"golang.org/x/sync/errgroup"
+	"k8s.io/klog/v2"
+)
+
+// ReflectorState ... the state of a supervised reflector
+type ReflectorState string
+
+const (
+	StateRunning ReflectorState = "running"
+	StateBackoff ReflectorState = "backoff"
+	StateFailed  ReflectorState = "failed"
+	StateStopped ReflectorState = "stopped"
+)
+
+var reflectorStates = []ReflectorState{StateRunning, StateBackoff, StateFailed, StateStopped}
+
+// SupervisorConfig ... the restart policy of the reflectors
+type SupervisorConfig struct {
+	// InitialBackoff is the delay of the first restart of a failed reflector, it is doubled by each consecutive failure
+	InitialBackoff time.Duration
+	// MaxBackoff bounds the delay of the restarts, a reflector that has run for longer than it is not failing consecutively anymore
+	MaxBackoff time.Duration
+	// MaxFailures is the budget of the consecutive failures of a reflector,
+	// the supervisor gives up and stops every reflector once a reflector exceeds it. zero means no limit
+	MaxFailures int
+}
+
+// SupervisedStatus ... the status of a supervised reflector
+type SupervisedStatus struct {
+	State               ReflectorState `json:"state"`
+	Restarts            int            `json:"restarts"`
+	ConsecutiveFailures int            `json:"consecutiveFailures"`
+	// Errors is the number of the errors that the reflector has reported and recovered from by itself
+	Errors        int       `json:"errors"`
+	LastError     string    `json:"lastError,omitempty"`
+	LastErrorTime time.Time `json:"lastErrorTime,omitempty"`
+}
+
+// Supervisor ...
+// runs each reflector in its own goroutine and restarts the one that fails with an exponential backoff,
+// so a failed reflector does not tear down the others until it has exceeded its failure budget
+type Supervisor struct {
+	cfg        SupervisorConfig
+	reflectors []supervisedReflector
+	// mu guards the statuses
+	mu       sync.Mutex
+	statuses map[string]*SupervisedStatus
+	// errorCounter counts the reported errors, failureCounter counts the failed runs
+	errorCounter   otelmetric.Int64Counter
+	failureCounter otelmetric.Int64Counter
+	restartCounter otelmetric.Int64Counter
+}
+
+type supervisedReflector struct {
+	name      string
+	reflector Reflector
+}
+
+// NewSupervisor ... create a new instance of *Supervisor
+func NewSupervisor(cfg SupervisorConfig) *Supervisor {
+	if cfg.InitialBackoff <= 0 {
+		cfg.InitialBackoff = time.Second
+	}
+	cfg.MaxBackoff = max(cfg.MaxBackoff, cfg.InitialBackoff)
+	meter := metrics.GetGlobalMeter()
+	out := &Supervisor{
+		cfg:      cfg,
+		statuses: map[string]*SupervisedStatus{},
+	}
+	out.errorCounter, _ = meter.Int64Counter("xds_reflector_errors")
+	out.failureCounter, _ = meter.Int64Counter("xds_reflector_failures")
+	out.restartCounter, _ = meter.Int64Counter("xds_reflector_restarts")
+	meter.Int64ObservableGauge("xds_reflector_state", otelmetric.WithInt64Callback(func(_ context.Context, o otelmetric.Int64Observer) error {
+		for name, status := range out.Statuses() {
+			for _, state := range reflectorStates {
+				var v int64
+				if status.State == state {
+					v = 1
+				}
+				o.Observe(v, otelmetric.WithAttributes(metrics.ReflectorAttrKey.String(name), metrics.StateAttrKey.String(string(state))))
+			}
+		}
+		return nil
+	}))
+	return out
+}
+
+// Add ... add the reflector of the name to be run by the Run
+func (s *Supervisor) Add(name string, r Reflector) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reflectors = append(s.reflectors, supervisedReflector{name: name, reflector: r})
+	s.statuses[name] = &SupervisedStatus{}
+}
+
+// Run ... run every reflector until the ctx is done or one of them has exceeded its failure budget
+func (s *Supervisor) Run(ctx context.Context) error {
+	g, ctx := errgroup.WithContext(ctx)
+	for _, r := range s.reflectors {
+		g.Go(func() error {
+			return s.supervise(ctx, r)
+		})
+	}
+	return g.Wait()
+}
+
+// Statuses ... the status of each reflector
+func (s *Supervisor) Statuses() map[string]SupervisedStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]SupervisedStatus, len(s.statuses))
+	for name, status := range s.statuses {
+		out[name] = *status
+	}
+	return out
+}
+
+// supervise ... run the reflector and restart it whenever it fails until the ctx is done
+func (s *Supervisor) supervise(ctx context.Context, r supervisedReflector) error {
+	attrs := otelmetric.WithAttributes(metrics.ReflectorAttrKey.String(r.name))
+	backoff := s.cfg.InitialBackoff
+	runCtx := withErrorReporter(ctx, func(err error) {
+		klog.Error("reflector error", "reflector", r.name, "err", err)
+		s.errorCounter.Add(context.Background(), 1, attrs)
+		s.update(r.name, func(status *SupervisedStatus) {
+			status.Errors++
+			status.LastError = err.Error()
+			status.LastErrorTime = time.Now()
+		})
+	})
+	for {
+		s.update(r.name, func(status *SupervisedStatus) {
+			status.State = StateRunning
+		})
+		started := time.Now()
+		err := s.watch(runCtx, r.reflector)
+		if ctx.Err() != nil {
+			s.update(r.name, func(status *SupervisedStatus) {
+				status.State = StateStopped
+			})
+			return nil
+		}
+		if err == nil {
+			err = errors.New("reflector stopped unexpectedly")
+		}
+		s.failureCounter.Add(ctx, 1, attrs)
+		var failures int
+		s.update(r.name, func(status *SupervisedStatus) {
+			// a reflector that has run for a while is not failing consecutively
+			if time.Since(started) > s.cfg.MaxBackoff {
+				status.ConsecutiveFailures = 0
+				backoff = s.cfg.InitialBackoff
+			}
+			status.ConsecutiveFailures++
+			status.LastError = err.Error()
+			status.LastErrorTime = time.Now()
+			status.State = StateBackoff
+			failures = status.ConsecutiveFailures
+		})
+		if s.cfg.MaxFailures > 0 && failures > s.cfg.MaxFailures {
+			s.update(r.name, func(status *SupervisedStatus) {
+				status.State = StateFailed
+			})
+			klog.Error("reflector has exceeded its failure budget", "reflector", r.name, "failures", failures, "err", err)
+			return fmt.Errorf("reflector %s has failed %d times consecutively: %w", r.name, failures, err)
+		}
+		klog.Error("reflector has failed, restarting it", "reflector", r.name, "backoff", backoff, "err", err)
+		select {
+		case <-ctx.Done():
+			s.update(r.name, func(status *SupervisedStatus) {
+				status.State = StateStopped
+			})
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, s.cfg.MaxBackoff)
+		s.restartCounter.Add(ctx, 1, attrs)
+		s.update(r.name, func(status *SupervisedStatus) {
+			status.Restarts++
+		})
+	}
+}
+
+// watch ... run the reflector by its own ctx that is canceled once it returns, so nothing of the failed run is left behind
+func (s *Supervisor) watch(ctx context.Context, r Reflector) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("reflector panicked: %v", v)
+		}
+	}()
+	return r.Watch(ctx)
+}
+
+func (s *Supervisor) update(name string, f func(status *SupervisedStatus)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(s.statuses[name])
+}
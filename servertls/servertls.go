@@ -0,0 +1,163 @@
+package servertls
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/sifer169966/go-xds/metrics"
+	"google.golang.org/grpc/credentials"
+	"k8s.io/klog/v2"
+)
+
+// reloadFailureCounter ... the number of the reloads of the files that have failed, the previous certificate is kept by them
+var reloadFailureCounter, _ = metrics.GetGlobalMeter().Int64Counter("xds_server_tls_reload_failures")
+
+// Config ... tls configuration of the xds gRPC listener
+type Config struct {
+	// CertFile and KeyFile are the PEM files of the certificate of the server
+	CertFile string
+	KeyFile  string
+	// ClientCAFile is the PEM file of the CAs that verify the certificates of the clients, they are not asked for one without it
+	ClientCAFile string
+	// RequireClientCert rejects the clients that have no certificate, it requires the ClientCAFile
+	RequireClientCert bool
+	// ReloadInterval is the interval to check the modification of the files
+	ReloadInterval time.Duration
+}
+
+// Validate ... validate that the files are configured together
+func (c Config) Validate() error {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return errors.New("both of the certificate and the key files are required")
+	}
+	if c.RequireClientCert && c.ClientCAFile == "" {
+		return errors.New("the client CA file is required to require the client certificates")
+	}
+	return nil
+}
+
+// Reloader ...
+// serves the certificate and the client CAs that have been loaded from the files most recently, so that the rotated files
+// are used by the new handshakes while the established connections, and so their streams, are kept as they are
+type Reloader struct {
+	cfg     Config
+	current atomic.Pointer[loaded]
+}
+
+// loaded ... the contents of the files and the tls config that has been built from them
+type loaded struct {
+	cert     []byte
+	key      []byte
+	clientCA []byte
+	config   *tls.Config
+}
+
+// NewReloader ... create a new instance of *Reloader, the files must be valid on the start
+func NewReloader(cfg Config) (*Reloader, error) {
+	err := cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ReloadInterval <= 0 {
+		cfg.ReloadInterval = 10 * time.Second
+	}
+	out := &Reloader{cfg: cfg}
+	_, err = out.reload()
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Credentials ... the transport credentials of the gRPC server that serve the current certificate of each handshake
+func (r *Reloader) Credentials() credentials.TransportCredentials {
+	return credentials.NewTLS(&tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.current.Load().config, nil
+		},
+	})
+}
+
+// Run ... reload the files whenever they are changed until the ctx is done, an invalid change is reported and the previous files are kept
+func (r *Reloader) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.cfg.ReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		changed, err := r.reload()
+		if err != nil {
+			reloadFailureCounter.Add(ctx, 1)
+			klog.Error("could not reload the tls files of the server, the previous ones are kept", "err", err)
+			continue
+		}
+		if changed {
+			klog.Info("reloaded the tls files of the server", "certFile", r.cfg.CertFile)
+		}
+	}
+}
+
+// reload ... load the files and report whether they have been changed since the last load
+func (r *Reloader) reload() (bool, error) {
+	cert, err := os.ReadFile(r.cfg.CertFile)
+	if err != nil {
+		return false, err
+	}
+	key, err := os.ReadFile(r.cfg.KeyFile)
+	if err != nil {
+		return false, err
+	}
+	var clientCA []byte
+	if r.cfg.ClientCAFile != "" {
+		clientCA, err = os.ReadFile(r.cfg.ClientCAFile)
+		if err != nil {
+			return false, err
+		}
+	}
+	previous := r.current.Load()
+	if previous != nil && bytes.Equal(cert, previous.cert) && bytes.Equal(key, previous.key) && bytes.Equal(clientCA, previous.clientCA) {
+		return false, nil
+	}
+	config, err := r.newConfig(cert, key, clientCA)
+	if err != nil {
+		return false, err
+	}
+	r.current.Store(&loaded{cert: cert, key: key, clientCA: clientCA, config: config})
+	return true, nil
+}
+
+// newConfig ... build the tls config of the handshakes from the contents of the files
+func (r *Reloader) newConfig(cert []byte, key []byte, clientCA []byte) (*tls.Config, error) {
+	pair, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate: %w", err)
+	}
+	out := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{pair},
+		NextProtos:   []string{"h2"},
+	}
+	if r.cfg.ClientCAFile == "" {
+		return out, nil
+	}
+	out.ClientCAs = x509.NewCertPool()
+	if !out.ClientCAs.AppendCertsFromPEM(clientCA) {
+		return nil, errors.New("invalid client CA: no certificate has been found")
+	}
+	out.ClientAuth = tls.VerifyClientCertIfGiven
+	if r.cfg.RequireClientCert {
+		out.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return out, nil
+}
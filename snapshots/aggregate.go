@@ -0,0 +1,141 @@
+package snapshots
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+	"sync"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"google.golang.org/protobuf/proto"
+	"k8s.io/klog/v2"
+)
+
+// LoadAssignmentAggregator ...
+// merges the eds resources of several k8s clusters into one ClusterLoadAssignment per cluster name.
+// the endpoints of each k8s cluster are put into their own localities of which sub zones are prefixed by the name of the k8s cluster,
+// and they are prioritized by the failover priority of the k8s cluster
+type LoadAssignmentAggregator struct {
+	snap SnapshotSetter
+	// mu guards the members and serializes the updates
+	mu      sync.Mutex
+	members []*aggregatorMember
+}
+
+// aggregatorMember ... the latest eds resources of a k8s cluster
+type aggregatorMember struct {
+	aggregator *LoadAssignmentAggregator
+	name       string
+	priority   uint32
+	version    string
+	resources  []types.Resource
+}
+
+// NewLoadAssignmentAggregator ... create a new instance of *LoadAssignmentAggregator that sets the merged eds resources into the s
+func NewLoadAssignmentAggregator(s SnapshotSetter) *LoadAssignmentAggregator {
+	return &LoadAssignmentAggregator{
+		snap: s,
+	}
+}
+
+// Member ... create a SnapshotSetter for the eds resources of a k8s cluster, the lower priority is preferred
+func (a *LoadAssignmentAggregator) Member(name string, priority uint32) SnapshotSetter {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	member := &aggregatorMember{
+		aggregator: a,
+		name:       name,
+		priority:   priority,
+	}
+	a.members = append(a.members, member)
+	slices.SortStableFunc(a.members, func(x, y *aggregatorMember) int {
+		return cmp.Compare(x.name, y.name)
+	})
+	return member
+}
+
+// Set ...
+// replace the eds resources of the k8s cluster and set the merged ones.
+// the resources are merged even if the other k8s clusters have not been synced yet so that an unreachable k8s cluster does not block the others
+func (m *aggregatorMember) Set(ctx context.Context, version string, src []types.Resource) {
+	a := m.aggregator
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	m.version = version
+	m.resources = src
+	versions := make([]string, 0, len(a.members))
+	for _, member := range a.members {
+		versions = append(versions, member.version)
+	}
+	a.snap.Set(ctx, strings.Join(versions, "."), a.merge())
+}
+
+// merge ... merge the eds resources of every member, the caller must hold the mu
+func (a *LoadAssignmentAggregator) merge() []types.Resource {
+	merged := map[string]*endpointv3.ClusterLoadAssignment{}
+	var names []string
+	for _, member := range a.members {
+		for _, res := range member.resources {
+			cla, ok := res.(*endpointv3.ClusterLoadAssignment)
+			if !ok {
+				klog.Error("only eds resources could be aggregated, the resource is skipped", "member", member.name, "typeURL", resourceType(res))
+				continue
+			}
+			out, ok := merged[cla.GetClusterName()]
+			if !ok {
+				out = &endpointv3.ClusterLoadAssignment{ClusterName: cla.GetClusterName()}
+				merged[cla.GetClusterName()] = out
+				names = append(names, cla.GetClusterName())
+			}
+			for _, endpoints := range cla.GetEndpoints() {
+				endpoints = proto.Clone(endpoints).(*endpointv3.LocalityLbEndpoints)
+				endpoints.Locality = memberLocality(member.name, endpoints.GetLocality())
+				endpoints.Priority = member.priority
+				out.Endpoints = append(out.Endpoints, endpoints)
+			}
+		}
+	}
+	slices.Sort(names)
+	out := make([]types.Resource, 0, len(names))
+	for _, name := range names {
+		cla := merged[name]
+		normalizePriorities(cla)
+		out = append(out, cla)
+	}
+	return out
+}
+
+// memberLocality ... put the locality into the sub zone of the k8s cluster so that each k8s cluster has its own localities
+func memberLocality(member string, locality *corev3.Locality) *corev3.Locality {
+	out := &corev3.Locality{
+		Region:  locality.GetRegion(),
+		Zone:    locality.GetZone(),
+		SubZone: member,
+	}
+	if locality.GetSubZone() != "" {
+		out.SubZone = member + "/" + locality.GetSubZone()
+	}
+	return out
+}
+
+// normalizePriorities ...
+// the priorities of the localities must start at zero without any gap, so the priorities of the k8s clusters
+// that have endpoints of the ClusterLoadAssignment are renumbered in their order
+func normalizePriorities(cla *endpointv3.ClusterLoadAssignment) {
+	var priorities []uint32
+	for _, endpoints := range cla.GetEndpoints() {
+		if !slices.Contains(priorities, endpoints.GetPriority()) {
+			priorities = append(priorities, endpoints.GetPriority())
+		}
+	}
+	slices.Sort(priorities)
+	for _, endpoints := range cla.GetEndpoints() {
+		endpoints.Priority = uint32(slices.Index(priorities, endpoints.GetPriority()))
+	}
+	slices.SortStableFunc(cla.Endpoints, func(x, y *endpointv3.LocalityLbEndpoints) int {
+		return cmp.Compare(x.GetPriority(), y.GetPriority())
+	})
+}
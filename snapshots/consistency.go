@@ -0,0 +1,85 @@
+package snapshots
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/sifer169966/go-xds/metrics"
+	otelmetric "go.opentelemetry.io/otel/metric"
+	"k8s.io/klog/v2"
+)
+
+// edsConsistency ...
+// checks that every eds resource is referenced by an eds cluster of the cds resources,
+// the cds and eds resources are set separately so they could be inconsistent for a moment but should not stay that way
+type edsConsistency struct {
+	// mu guards the edsClusterNames and the loadAssignmentNames
+	mu                  sync.Mutex
+	edsClusterNames     map[string]struct{}
+	loadAssignmentNames []string
+	dangling            atomic.Int64
+}
+
+func newEDSConsistency() *edsConsistency {
+	out := &edsConsistency{
+		edsClusterNames: map[string]struct{}{},
+	}
+	meter := metrics.GetGlobalMeter()
+	meter.Int64ObservableGauge("xds_snapshot_dangling_eds_resources", otelmetric.WithInt64Callback(func(_ context.Context, o otelmetric.Int64Observer) error {
+		o.Observe(out.dangling.Load())
+		return nil
+	}))
+	return out
+}
+
+// setClusters ... replace the cds resources to check against
+func (c *edsConsistency) setClusters(resources []types.Resource) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.edsClusterNames = map[string]struct{}{}
+	for _, res := range resources {
+		cluster, ok := res.(*clusterv3.Cluster)
+		if !ok || cluster.GetType() != clusterv3.Cluster_EDS {
+			continue
+		}
+		name := cluster.GetEdsClusterConfig().GetServiceName()
+		if name == "" {
+			name = cluster.GetName()
+		}
+		c.edsClusterNames[name] = struct{}{}
+	}
+	c.check()
+}
+
+// setLoadAssignments ... replace the eds resources to check
+func (c *edsConsistency) setLoadAssignments(resources []types.Resource) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.loadAssignmentNames = c.loadAssignmentNames[:0]
+	for _, res := range resources {
+		if cla, ok := res.(*endpointv3.ClusterLoadAssignment); ok {
+			c.loadAssignmentNames = append(c.loadAssignmentNames, cla.GetClusterName())
+		}
+	}
+	slices.Sort(c.loadAssignmentNames)
+	c.check()
+}
+
+// check ... report the eds resources that are not referenced by any eds cluster, the caller must hold the mu
+func (c *edsConsistency) check() {
+	var dangling []string
+	for _, name := range c.loadAssignmentNames {
+		if _, ok := c.edsClusterNames[name]; !ok {
+			dangling = append(dangling, name)
+		}
+	}
+	c.dangling.Store(int64(len(dangling)))
+	if len(dangling) > 0 {
+		klog.Warning("eds resources are not referenced by any eds cluster", "count", len(dangling), "clusterNames", dangling)
+	}
+}
@@ -0,0 +1,147 @@
+package snapshots
+
+import (
+	"slices"
+	"strings"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	listenerv3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	resourcev3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	// MetadataFilterName ... the filter metadata of the resources that the snapshots read to filter them
+	MetadataFilterName = "xds.go-xds.io"
+	metadataNamespace  = "namespace"
+)
+
+// SecretName ... the name of the sds resource of a k8s secret, it is prefixed by the namespace that the secret belongs to
+func SecretName(namespace string, name string) string {
+	return namespace + "/" + name
+}
+
+// NamespaceMetadata ... the metadata that tags a cluster or a listener with the k8s namespace that it belongs to
+func NamespaceMetadata(namespace string) *corev3.Metadata {
+	return &corev3.Metadata{
+		FilterMetadata: map[string]*structpb.Struct{
+			MetadataFilterName: {
+				Fields: map[string]*structpb.Value{
+					metadataNamespace: structpb.NewStringValue(namespace),
+				},
+			},
+		},
+	}
+}
+
+// resourceNamespace ... the namespace of the NamespaceMetadata, a resource without it belongs to no namespace
+func resourceNamespace(metadata *corev3.Metadata) (string, bool) {
+	v, ok := metadata.GetFilterMetadata()[MetadataFilterName].GetFields()[metadataNamespace]
+	if !ok {
+		return "", false
+	}
+	return v.GetStringValue(), true
+}
+
+// ResourceFilter ... filters the resources that a group of the clients is allowed to see
+type ResourceFilter interface {
+	// Filter returns the resources of each type url that the group sees, the resources of every type are given
+	// since the visibility of a resource could rely on the ones of the other types
+	Filter(group string, resources map[string][]types.Resource) map[string][]types.Resource
+}
+
+// NamespaceFilter ...
+// filters the clusters and listeners by their NamespaceMetadata, the resources without it are visible to every group.
+// a route configuration is visible along with the listener of the same name,
+// and a load assignment is only visible when a visible eds cluster refers to it.
+// a secret belongs to the namespace of its SecretName, the secrets of the other names are visible to every group
+type NamespaceFilter struct {
+	// Shared are the namespaces that are visible to every group
+	Shared []string
+	// Groups are the namespaces that each group sees, a group without any entry only sees the namespace of its own name
+	Groups map[string][]string
+}
+
+// visible ... whether the group is allowed to see the namespace
+func (f NamespaceFilter) visible(group string, namespace string) bool {
+	if slices.Contains(f.Shared, namespace) {
+		return true
+	}
+	namespaces, ok := f.Groups[group]
+	if !ok {
+		return group != "" && namespace == group
+	}
+	return slices.Contains(namespaces, namespace)
+}
+
+// Namespaces ... the namespaces that the group sees besides the Shared ones
+func (f NamespaceFilter) Namespaces(group string) []string {
+	namespaces, ok := f.Groups[group]
+	if !ok {
+		if group == "" {
+			return nil
+		}
+		return []string{group}
+	}
+	return namespaces
+}
+
+// Filter ...
+func (f NamespaceFilter) Filter(group string, resources map[string][]types.Resource) map[string][]types.Resource {
+	out := map[string][]types.Resource{}
+	hiddenListeners := map[string]struct{}{}
+	for _, res := range resources[resourcev3.ListenerType] {
+		lds := res.(*listenerv3.Listener)
+		if ns, ok := resourceNamespace(lds.GetMetadata()); ok && !f.visible(group, ns) {
+			hiddenListeners[lds.GetName()] = struct{}{}
+			continue
+		}
+		out[resourcev3.ListenerType] = append(out[resourcev3.ListenerType], res)
+	}
+	for _, res := range resources[resourcev3.RouteType] {
+		if _, ok := hiddenListeners[res.(*routev3.RouteConfiguration).GetName()]; ok {
+			continue
+		}
+		out[resourcev3.RouteType] = append(out[resourcev3.RouteType], res)
+	}
+	loadAssignments := map[string]struct{}{}
+	for _, res := range resources[resourcev3.ClusterType] {
+		cds := res.(*clusterv3.Cluster)
+		if ns, ok := resourceNamespace(cds.GetMetadata()); ok && !f.visible(group, ns) {
+			continue
+		}
+		out[resourcev3.ClusterType] = append(out[resourcev3.ClusterType], res)
+		if cds.GetType() == clusterv3.Cluster_EDS {
+			name := cds.GetEdsClusterConfig().GetServiceName()
+			if name == "" {
+				name = cds.GetName()
+			}
+			loadAssignments[name] = struct{}{}
+		}
+	}
+	for _, res := range resources[resourcev3.EndpointType] {
+		if _, ok := loadAssignments[res.(*endpointv3.ClusterLoadAssignment).GetClusterName()]; ok {
+			out[resourcev3.EndpointType] = append(out[resourcev3.EndpointType], res)
+		}
+	}
+	for _, res := range resources[resourcev3.SecretType] {
+		if ns, _, ok := strings.Cut(res.(*tlsv3.Secret).GetName(), "/"); ok && !f.visible(group, ns) {
+			continue
+		}
+		out[resourcev3.SecretType] = append(out[resourcev3.SecretType], res)
+	}
+	// the other types have no namespace
+	for typeURL, typed := range resources {
+		switch typeURL {
+		case resourcev3.ListenerType, resourcev3.RouteType, resourcev3.ClusterType, resourcev3.EndpointType, resourcev3.SecretType:
+		default:
+			out[typeURL] = typed
+		}
+	}
+	return out
+}
@@ -0,0 +1,196 @@
+package snapshots
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
+	"k8s.io/klog/v2"
+)
+
+// mergedResources ... the resources of a kind that have been merged from every source
+type mergedResources struct {
+	version   string
+	resources map[string][]types.Resource
+}
+
+// groupCache ...
+// builds the snapshot of the group of a client on its first request,
+// the snapshots of the groups that are known already are built whenever the resources are changed
+type groupCache struct {
+	cachev3.SnapshotCache
+	snap *Snapshot
+}
+
+// CreateWatch ...
+func (c groupCache) CreateWatch(request *cachev3.Request, state stream.StreamState, value chan cachev3.Response) func() {
+	return c.snap.watch(c.snap.nodeHash.ID(request.GetNode()), func() func() {
+		return c.SnapshotCache.CreateWatch(request, state, value)
+	})
+}
+
+// CreateDeltaWatch ...
+func (c groupCache) CreateDeltaWatch(request *cachev3.DeltaRequest, state stream.StreamState, value chan cachev3.DeltaResponse) func() {
+	return c.snap.watch(c.snap.nodeHash.ID(request.GetNode()), func() func() {
+		return c.SnapshotCache.CreateDeltaWatch(request, state, value)
+	})
+}
+
+// groupWatches ... the open watches of the clients of a group and since when it has had none
+type groupWatches struct {
+	count     int
+	idleSince time.Time
+}
+
+// watch ...
+// create a watch of a client of the group by the create, the group is known until its last watch has been cancelled
+// for the GroupIdleTTL. the server cancels the watches of a stream when it is closed
+func (s *Snapshot) watch(group string, create func() func()) func() {
+	s.acquireGroup(group)
+	s.ensureGroup(group)
+	cancel := create()
+	if cancel == nil {
+		// the watch has been responded already, the next request of the client opens another one
+		s.releaseGroup(group)
+		return nil
+	}
+	var once sync.Once
+	return func() {
+		cancel()
+		once.Do(func() {
+			s.releaseGroup(group)
+		})
+	}
+}
+
+// acquireGroup ... count a watch of the group, so it is not evicted
+func (s *Snapshot) acquireGroup(group string) {
+	s.watchesMu.Lock()
+	defer s.watchesMu.Unlock()
+	w, ok := s.watches[group]
+	if !ok {
+		w = &groupWatches{}
+		s.watches[group] = w
+	}
+	w.count++
+}
+
+// releaseGroup ... uncount a watch of the group and schedule its eviction once it has no watch anymore
+func (s *Snapshot) releaseGroup(group string) {
+	s.watchesMu.Lock()
+	defer s.watchesMu.Unlock()
+	w := s.watches[group]
+	w.count--
+	if w.count > 0 || s.groupIdleTTL <= 0 || group == (DefaultNodeID{}).ID(nil) {
+		return
+	}
+	w.idleSince = time.Now()
+	time.AfterFunc(s.groupIdleTTL, func() {
+		s.evictGroup(group)
+	})
+}
+
+// evictGroup ...
+// forget the group and its snapshots if it has had no watch for the GroupIdleTTL, so that the groups of the clients that are gone,
+// e.g. the pods of the previous deployments that are grouped by their node id, are not built on every update forever
+func (s *Snapshot) evictGroup(group string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.groupsMu.Lock()
+	defer s.groupsMu.Unlock()
+	s.watchesMu.Lock()
+	defer s.watchesMu.Unlock()
+	w, ok := s.watches[group]
+	// the group has been watched again, or it has been released again after this eviction was scheduled
+	if !ok || w.count > 0 || time.Since(w.idleSince) < s.groupIdleTTL {
+		return
+	}
+	delete(s.watches, group)
+	delete(s.groups, group)
+	s.mixedSnapshotCache.ClearSnapshot(group)
+	for _, lc := range s.linearCaches {
+		lc.evict(group)
+	}
+	klog.Info("group of the clients has been evicted", "group", group, "idleTTL", s.groupIdleTTL)
+}
+
+// ensureGroup ... register the group and build its snapshots if it is not known yet
+func (s *Snapshot) ensureGroup(group string) {
+	s.groupsMu.RLock()
+	_, ok := s.groups[group]
+	s.groupsMu.RUnlock()
+	if ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.groupsMu.Lock()
+	_, ok = s.groups[group]
+	s.groups[group] = struct{}{}
+	s.groupsMu.Unlock()
+	if ok {
+		return
+	}
+	klog.Info("new group of the clients", "group", group)
+	// the kinds that have no resources yet are built along with the other groups once they are set
+	for kind := range s.merged {
+		s.publishGroup(context.Background(), kind, group)
+	}
+}
+
+// publish ... build the snapshot of the kind of every group, the caller must hold the mu
+func (s *Snapshot) publish(ctx context.Context, kind string) {
+	s.groupsMu.RLock()
+	groups := make([]string, 0, len(s.groups))
+	for group := range s.groups {
+		groups = append(groups, group)
+	}
+	s.groupsMu.RUnlock()
+	for _, group := range groups {
+		s.publishGroup(ctx, kind, group)
+	}
+}
+
+// publishGroup ...
+// build the snapshot of the kind of the group from the merged resources that the group is allowed to see, the caller must hold the mu.
+// the resources of the types that are served by the linear caches are updated there and the rest are set into the snapshot cache,
+// along with the ones of the linear caches that only serve the delta clients
+func (s *Snapshot) publishGroup(ctx context.Context, kind string, group string) {
+	merged := s.merged[kind]
+	resources := merged.resources
+	if s.filter != nil {
+		all := map[string][]types.Resource{}
+		for _, m := range s.merged {
+			for typeURL, typed := range m.resources {
+				all[typeURL] = typed
+			}
+		}
+		resources = s.filter.Filter(group, all)
+	}
+	snapshotResources := map[string][]types.Resource{}
+	for typeURL, typed := range resources {
+		if lc, ok := s.linearCaches[typeURL]; (!ok || lc.deltaOnly) && getResourceKeyName(typeURL) == kind {
+			snapshotResources[typeURL] = typed
+		}
+	}
+	for typeURL, lc := range s.linearCaches {
+		if getResourceKeyName(typeURL) == kind {
+			lc.set(group, merged.version, resources[typeURL])
+		}
+	}
+	if kind != resourceKindMixed {
+		return
+	}
+	snapshot, err := cachev3.NewSnapshot(merged.version, snapshotResources)
+	if err != nil {
+		klog.Error("could not create a new snapshot", "version", merged.version, "kind", kind, "group", group, "err", err)
+		return
+	}
+	err = s.mixedSnapshotCache.SetSnapshot(ctx, group, snapshot)
+	if err != nil {
+		klog.Error("could not set the snapshot", "version", merged.version, "kind", kind, "group", group, "err", err)
+	}
+}
@@ -0,0 +1,141 @@
+package snapshots
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	resourcev3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
+)
+
+// newGroupSnapshot ... a snapshot that groups the clients by their node ids and has a cluster to serve them
+func newGroupSnapshot(idleTTL time.Duration) *Snapshot {
+	s := New(Config{NodeHash: NodeIDHash{}, GroupIdleTTL: idleTTL})
+	s.Set(context.Background(), "v1", []types.Resource{&clusterv3.Cluster{Name: "a"}})
+	return s
+}
+
+// watchClusters ...
+// open a SotW watch of the clusters of the node, it is answered right away unless the version is the one of the snapshot.
+// the group is released by the cancel, which the server calls by the next request of the client or once the stream is closed
+func watchClusters(s *Snapshot, node string, version string) (chan cachev3.Response, func()) {
+	value := make(chan cachev3.Response, 1)
+	cancel := s.muxCache.CreateWatch(&cachev3.Request{
+		Node:        &corev3.Node{Id: node},
+		TypeUrl:     resourcev3.ClusterType,
+		VersionInfo: version,
+	}, stream.NewStreamState(true, nil), value)
+	if cancel == nil {
+		cancel = func() {}
+	}
+	return value, cancel
+}
+
+// hasGroup ... whether the group is known and has its snapshot
+func hasGroup(s *Snapshot, group string) bool {
+	s.groupsMu.RLock()
+	_, ok := s.groups[group]
+	s.groupsMu.RUnlock()
+	_, err := s.mixedSnapshotCache.GetSnapshot(group)
+	return ok && err == nil
+}
+
+// idleFor ... pretend that the group has had no watch for the duration
+func idleFor(s *Snapshot, group string, d time.Duration) {
+	s.watchesMu.Lock()
+	defer s.watchesMu.Unlock()
+	s.watches[group].idleSince = time.Now().Add(-d)
+}
+
+// TestGroupIsEvictedAfterIdleTTL ... a group is evicted once it has had no watch for the GroupIdleTTL
+func TestGroupIsEvictedAfterIdleTTL(t *testing.T) {
+	s := newGroupSnapshot(50 * time.Millisecond)
+	value, cancel := watchClusters(s, "n1", "")
+	<-value
+	cancel()
+	if !hasGroup(s, "n1") {
+		t.Fatal("the group has not been built")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for hasGroup(s, "n1") {
+		if time.Now().After(deadline) {
+			t.Fatal("the group has not been evicted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !hasGroup(s, DefaultNodeID{}.ID(nil)) {
+		t.Fatal("the default group has been evicted")
+	}
+}
+
+// TestGroupWithOpenWatchIsNotEvicted ... a group is kept while one of its clients has a watch however long it has been idle before
+func TestGroupWithOpenWatchIsNotEvicted(t *testing.T) {
+	s := newGroupSnapshot(time.Hour)
+	value, cancel := watchClusters(s, "n1", "")
+	<-value
+	cancel()
+	_, cancel = watchClusters(s, "n1", "v1")
+	idleFor(s, "n1", 2*time.Hour)
+	s.evictGroup("n1")
+	if !hasGroup(s, "n1") {
+		t.Fatal("the group of an open watch has been evicted")
+	}
+	// cancelling twice, e.g. by the server and by a response, releases the group once
+	cancel()
+	cancel()
+	if count := s.watches["n1"].count; count != 0 {
+		t.Fatalf("got %d watches of the group, want 0", count)
+	}
+	idleFor(s, "n1", 2*time.Hour)
+	s.evictGroup("n1")
+	if hasGroup(s, "n1") {
+		t.Fatal("the idle group has not been evicted")
+	}
+}
+
+// TestGroupReleasedAgainIsNotEvictedEarly ...
+// the eviction that was scheduled by an earlier release does not evict a group that has been watched and released again since,
+// its idle time counts from the latest release
+func TestGroupReleasedAgainIsNotEvictedEarly(t *testing.T) {
+	s := newGroupSnapshot(time.Hour)
+	value, cancel := watchClusters(s, "n1", "")
+	<-value
+	cancel()
+	idleFor(s, "n1", 2*time.Hour)
+	// the client comes back before the scheduled eviction runs
+	value, cancel = watchClusters(s, "n1", "")
+	<-value
+	cancel()
+	s.evictGroup("n1")
+	if !hasGroup(s, "n1") {
+		t.Fatal("the group has been evicted by the eviction of its earlier release")
+	}
+}
+
+// TestEvictedGroupIsBuiltAgain ... a client of an evicted group gets its snapshot again
+func TestEvictedGroupIsBuiltAgain(t *testing.T) {
+	s := newGroupSnapshot(time.Hour)
+	value, cancel := watchClusters(s, "n1", "")
+	<-value
+	cancel()
+	idleFor(s, "n1", 2*time.Hour)
+	s.evictGroup("n1")
+	if hasGroup(s, "n1") {
+		t.Fatal("the idle group has not been evicted")
+	}
+	value, cancel = watchClusters(s, "n1", "")
+	defer cancel()
+	select {
+	case resp := <-value:
+		if n := len(resp.(*cachev3.RawResponse).Resources); n != 1 {
+			t.Fatalf("got %d clusters, want 1", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no response")
+	}
+}
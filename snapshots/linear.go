@@ -0,0 +1,286 @@
+package snapshots
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxLinearVersions is the number of the recent versions of each group that the SotW requests could be up to date with
+const maxLinearVersions = 16
+
+// linearCache ...
+// serves the resources of a type url from a LinearCache of each group of the clients.
+// each resource has its own version, so only the changed resources are sent to the clients
+// of both the delta and the SotW protocols, except the SotW wildcard requests that always get every resource.
+// a deltaOnly cache only serves the delta clients, its resources are served to the SotW clients by the snapshot cache.
+//
+// the delta clients are served the hashes of the resources as their versions, and the SotW clients are served the version
+// of the merged resources instead of the counter of the LinearCache, so that both are the same on every replica.
+// the counter is still kept by each process, so a SotW client that comes from another replica with a version
+// that is not one of the recent ones of the group gets every resource that it subscribes to
+type linearCache struct {
+	snap      *Snapshot
+	typeURL   string
+	deltaOnly bool
+	// mu guards the groups
+	mu     sync.RWMutex
+	groups map[string]*linearGroup
+}
+
+// linearGroup ... the LinearCache of a group and the recent versions that have been served from it
+type linearGroup struct {
+	cache *cachev3.LinearCache
+	// version is the version of the current resources
+	version string
+	// counter is the number of the updates of the cache, it is the version of the LinearCache
+	counter uint64
+	// history are the recent versions by the counters of the cache that they have been served by, the oldest first
+	history []linearVersion
+}
+
+type linearVersion struct {
+	counter uint64
+	version string
+}
+
+func newLinearCache(s *Snapshot, typeURL string, deltaOnly bool) *linearCache {
+	return &linearCache{
+		snap:      s,
+		typeURL:   typeURL,
+		deltaOnly: deltaOnly,
+		groups:    map[string]*linearGroup{},
+	}
+}
+
+// group ... the cache of the group, it is created when the group has none yet
+func (c *linearCache) group(group string) *linearGroup {
+	c.mu.RLock()
+	g, ok := c.groups[group]
+	c.mu.RUnlock()
+	if ok {
+		return g
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if g, ok = c.groups[group]; !ok {
+		g = &linearGroup{cache: cachev3.NewLinearCache(c.typeURL)}
+		c.groups[group] = g
+	}
+	return g
+}
+
+// set ...
+// update the resources of the group that have been changed and delete the ones that are not set anymore,
+// the caller must serialize the sets. the resources of a filtered group are versioned by their own hash along with the version
+// of the merged resources since they could be changed by the resources of the other types
+func (c *linearCache) set(group string, version string, resources []types.Resource) {
+	g := c.group(group)
+	current := g.cache.GetResources()
+	toUpdate := map[string]types.Resource{}
+	for _, res := range resources {
+		name := cachev3.GetResourceName(res)
+		if previous, ok := current[name]; !ok || !proto.Equal(previous, res) {
+			toUpdate[name] = res
+		}
+		delete(current, name)
+	}
+	toDelete := make([]string, 0, len(current))
+	for name := range current {
+		toDelete = append(toDelete, name)
+	}
+	if c.snap.filter != nil {
+		version += "-" + strconv.FormatUint(contentHash(resources), 16)
+	}
+	changed := len(toUpdate) > 0 || len(toDelete) > 0
+	c.mu.Lock()
+	if changed {
+		// the UpdateResources increases the counter of the LinearCache by one
+		g.counter++
+	}
+	if changed || version != g.version {
+		g.version = version
+		g.history = append(g.history, linearVersion{counter: g.counter, version: version})
+		if len(g.history) > maxLinearVersions {
+			g.history = slices.Delete(g.history, 0, len(g.history)-maxLinearVersions)
+		}
+	}
+	c.mu.Unlock()
+	if !changed {
+		return
+	}
+	// the error is only returned for the nil resources
+	_ = g.cache.UpdateResources(toUpdate, toDelete)
+}
+
+// counterOf ... the counter of the cache of the latest resources of the version, the caller must hold the mu
+func (g *linearGroup) counterOf(version string) (uint64, bool) {
+	for i := len(g.history) - 1; i >= 0; i-- {
+		if g.history[i].version == version {
+			return g.history[i].counter, true
+		}
+	}
+	return 0, false
+}
+
+// versionOf ... the version of the resources of the counter of the cache, the caller must hold the mu
+func (g *linearGroup) versionOf(counter uint64) (string, bool) {
+	for i := len(g.history) - 1; i >= 0; i-- {
+		if g.history[i].counter == counter {
+			return g.history[i].version, true
+		}
+	}
+	return "", false
+}
+
+// evict ... drop the cache of the group, its watches have been cancelled already
+func (c *linearCache) evict(group string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.groups, group)
+}
+
+// CreateWatch ...
+func (c *linearCache) CreateWatch(request *cachev3.Request, state stream.StreamState, value chan cachev3.Response) func() {
+	group := c.snap.nodeHash.ID(request.GetNode())
+	return c.snap.watch(group, func() func() {
+		return c.createWatch(c.group(group), request, state, value)
+	})
+}
+
+// createWatch ...
+// the version of the request is translated into the counter of the LinearCache, and the counter of its response is translated back
+func (c *linearCache) createWatch(g *linearGroup, request *cachev3.Request, state stream.StreamState, value chan cachev3.Response) func() {
+	translated := proto.Clone(request).(*cachev3.Request)
+	// an unknown version is not a counter, so the LinearCache takes the client as out of date
+	translated.VersionInfo = ""
+	c.mu.RLock()
+	if counter, ok := g.counterOf(request.GetVersionInfo()); ok {
+		translated.VersionInfo = strconv.FormatUint(counter, 10)
+	}
+	c.mu.RUnlock()
+	responses := make(chan cachev3.Response, 1)
+	cancel := g.cache.CreateWatch(translated, state, responses)
+	select {
+	case resp := <-responses:
+		value <- c.relabel(g, request, resp)
+		return nil
+	default:
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case resp := <-responses:
+			select {
+			case value <- c.relabel(g, request, resp):
+			case <-done:
+			}
+		case <-done:
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			if cancel != nil {
+				cancel()
+			}
+		})
+	}
+}
+
+// relabel ... the response of the request that is versioned by the version of its counter
+func (c *linearCache) relabel(g *linearGroup, request *cachev3.Request, resp cachev3.Response) cachev3.Response {
+	raw, ok := resp.(*cachev3.RawResponse)
+	if !ok {
+		return resp
+	}
+	counter, err := strconv.ParseUint(raw.Version, 10, 64)
+	if err != nil {
+		return resp
+	}
+	c.mu.RLock()
+	version, ok := g.versionOf(counter)
+	c.mu.RUnlock()
+	if !ok {
+		// the version is too old to be known, the client gets every resource on its next request
+		return resp
+	}
+	return &cachev3.RawResponse{
+		Request:   request,
+		Version:   version,
+		Resources: raw.Resources,
+		Heartbeat: raw.Heartbeat,
+		Ctx:       raw.Ctx,
+	}
+}
+
+// CreateDeltaWatch ...
+func (c *linearCache) CreateDeltaWatch(request *cachev3.DeltaRequest, state stream.StreamState, value chan cachev3.DeltaResponse) func() {
+	group := c.snap.nodeHash.ID(request.GetNode())
+	return c.snap.watch(group, func() func() {
+		return c.group(group).cache.CreateDeltaWatch(request, state, value)
+	})
+}
+
+// Fetch ...
+func (c *linearCache) Fetch(context.Context, *cachev3.Request) (cachev3.Response, error) {
+	return nil, errors.New("not implemented")
+}
+
+// GetStatusKeys ... the groups that have their own caches
+func (c *linearCache) GetStatusKeys() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	out := make([]string, 0, len(c.groups))
+	for group := range c.groups {
+		out = append(out, group)
+	}
+	slices.Sort(out)
+	return out
+}
+
+// GetSnapshot ... a snapshot of the current resources of the group to be inspected
+func (c *linearCache) GetSnapshot(group string) (cachev3.ResourceSnapshot, error) {
+	c.mu.RLock()
+	g, ok := c.groups[group]
+	var version string
+	if ok {
+		version = g.version
+	}
+	c.mu.RUnlock()
+	if !ok {
+		return nil, errors.New("no resources for the group " + group)
+	}
+	resources := make([]types.Resource, 0, g.cache.NumResources())
+	for _, res := range g.cache.GetResources() {
+		resources = append(resources, res)
+	}
+	return cachev3.NewSnapshot(version, map[string][]types.Resource{c.typeURL: resources})
+}
+
+// contentHash ... the hash of the resources by their names, it is the same on every replica for the same resources
+func contentHash(resources []types.Resource) uint64 {
+	sorted := slices.Clone(resources)
+	slices.SortFunc(sorted, func(a, b types.Resource) int {
+		return cmp.Compare(cachev3.GetResourceName(a), cachev3.GetResourceName(b))
+	})
+	h := xxhash.New()
+	var b []byte
+	for _, res := range sorted {
+		// the resources are valid, so they could always be marshaled
+		b, _ = proto.MarshalOptions{Deterministic: true}.MarshalAppend(b[:0], res)
+		h.Write(b)
+		h.Write([]byte{'\xff'})
+	}
+	return h.Sum64()
+}
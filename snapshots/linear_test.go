@@ -0,0 +1,172 @@
+package snapshots
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	resourcev3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
+)
+
+// noResponseWait is how long a watch that is up to date is expected to stay without a response
+const noResponseWait = 100 * time.Millisecond
+
+// newLoadAssignment ... a load assignment of the cluster with an endpoint of the ip
+func newLoadAssignment(cluster string, ip string) *endpointv3.ClusterLoadAssignment {
+	return &endpointv3.ClusterLoadAssignment{
+		ClusterName: cluster,
+		Endpoints: []*endpointv3.LocalityLbEndpoints{{
+			LbEndpoints: []*endpointv3.LbEndpoint{{
+				HostIdentifier: &endpointv3.LbEndpoint_Endpoint{
+					Endpoint: &endpointv3.Endpoint{
+						Address: &corev3.Address{
+							Address: &corev3.Address_SocketAddress{
+								SocketAddress: &corev3.SocketAddress{
+									Address:       ip,
+									PortSpecifier: &corev3.SocketAddress_PortValue{PortValue: 8080},
+								},
+							},
+						},
+					},
+				},
+			}},
+		}},
+	}
+}
+
+// setEndpoints ...
+// set the load assignment of the cluster "a" with an endpoint of the ip into the snapshot, along with the one of the cluster "b"
+// that is never changed, so that a response of only the changed resource could be told from the one of every resource
+func setEndpoints(s *Snapshot, ip string) {
+	s.Set(context.Background(), ip, []types.Resource{newLoadAssignment("a", ip), newLoadAssignment("b", "10.1.0.1")})
+}
+
+// watchEndpoints ... open a SotW watch of the load assignments of the clusters "a" and "b" at the version
+func watchEndpoints(s *Snapshot, version string) (chan cachev3.Response, func()) {
+	value := make(chan cachev3.Response, 1)
+	cancel := s.linearCaches[resourcev3.EndpointType].CreateWatch(&cachev3.Request{
+		TypeUrl:       resourcev3.EndpointType,
+		ResourceNames: []string{"a", "b"},
+		VersionInfo:   version,
+	}, stream.NewStreamState(false, nil), value)
+	if cancel == nil {
+		cancel = func() {}
+	}
+	return value, cancel
+}
+
+// receive ... the response of the watch, it fails if there is none in time
+func receive(t *testing.T, value chan cachev3.Response) (string, int) {
+	t.Helper()
+	select {
+	case resp := <-value:
+		version, err := resp.GetVersion()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return version, len(resp.(*cachev3.RawResponse).Resources)
+	case <-time.After(time.Second):
+		t.Fatal("no response")
+		return "", 0
+	}
+}
+
+// expectNoResponse ... the watch must stay open without a response
+func expectNoResponse(t *testing.T, value chan cachev3.Response) {
+	t.Helper()
+	select {
+	case resp := <-value:
+		version, _ := resp.GetVersion()
+		t.Fatalf("unexpected response of version %s", version)
+	case <-time.After(noResponseWait):
+	}
+}
+
+// TestLinearCacheResumesKnownVersion ... a client that is up to date with a version of the group is not sent the resources again
+func TestLinearCacheResumesKnownVersion(t *testing.T) {
+	s := New(Config{})
+	setEndpoints(s, "10.0.0.1")
+	value, cancel := watchEndpoints(s, "")
+	defer cancel()
+	version, n := receive(t, value)
+	if n != 2 {
+		t.Fatalf("got %d resources, want 2", n)
+	}
+	if _, err := strconv.ParseUint(version, 10, 64); err == nil {
+		t.Fatalf("the version %s is the counter of the LinearCache", version)
+	}
+
+	value, cancel = watchEndpoints(s, version)
+	defer cancel()
+	expectNoResponse(t, value)
+	setEndpoints(s, "10.0.0.2")
+	next, n := receive(t, value)
+	if n != 1 || next == version {
+		t.Fatalf("got %d resources of the version %s after %s, want the changed resource", n, next, version)
+	}
+}
+
+// TestLinearCacheResendsUnknownVersion ... a client of a version that the group has never served, e.g. of another replica, gets every resource
+func TestLinearCacheResendsUnknownVersion(t *testing.T) {
+	s := New(Config{})
+	setEndpoints(s, "10.0.0.1")
+	value, cancel := watchEndpoints(s, "a-version-of-another-replica")
+	defer cancel()
+	if _, n := receive(t, value); n != 2 {
+		t.Fatalf("got %d resources, want 2", n)
+	}
+}
+
+// TestLinearCacheVersionsAreTheSameOnEveryReplica ... the same resources are served by the same versions by every snapshot
+func TestLinearCacheVersionsAreTheSameOnEveryReplica(t *testing.T) {
+	replica := New(Config{})
+	// the counter of the LinearCache of the replica is different
+	setEndpoints(replica, "10.0.0.2")
+	setEndpoints(replica, "10.0.0.1")
+	s := New(Config{})
+	setEndpoints(s, "10.0.0.1")
+
+	value, cancel := watchEndpoints(replica, "")
+	defer cancel()
+	version, _ := receive(t, value)
+	value, cancel = watchEndpoints(s, version)
+	defer cancel()
+	expectNoResponse(t, value)
+}
+
+// TestLinearCacheEvictsOldVersions ... only the recent versions of the group are remembered, a client of an older one gets every resource
+func TestLinearCacheEvictsOldVersions(t *testing.T) {
+	s := New(Config{})
+	setEndpoints(s, "10.0.0.0")
+	value, cancel := watchEndpoints(s, "")
+	defer cancel()
+	oldest, _ := receive(t, value)
+	for i := 1; i <= maxLinearVersions; i++ {
+		setEndpoints(s, "10.0.0."+strconv.Itoa(i))
+	}
+	g := s.linearCaches[resourcev3.EndpointType].group(DefaultNodeID{}.ID(nil))
+	if len(g.history) != maxLinearVersions {
+		t.Fatalf("got %d versions in the history, want %d", len(g.history), maxLinearVersions)
+	}
+
+	value, cancel = watchEndpoints(s, oldest)
+	defer cancel()
+	if _, n := receive(t, value); n != 2 {
+		t.Fatalf("got %d resources of the evicted version, want 2", n)
+	}
+	// the oldest version that is remembered is out of date, but only the changed resource is sent
+	value, cancel = watchEndpoints(s, g.history[0].version)
+	defer cancel()
+	if _, n := receive(t, value); n != 1 {
+		t.Fatalf("got %d resources of the oldest known version, want 1", n)
+	}
+	value, cancel = watchEndpoints(s, g.version)
+	defer cancel()
+	expectNoResponse(t, value)
+}
@@ -1,6 +1,12 @@
 package snapshots
 
-import corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+import (
+	"fmt"
+	"strings"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+)
 
 // DefaultNodeID ...
 // uses the default nodeID to let all clients relies on the same version of resources
@@ -10,3 +16,61 @@ type DefaultNodeID struct{}
 func (DefaultNodeID) ID(node *corev3.Node) string {
 	return "default"
 }
+
+// NodeIDHash ... groups the clients by their node id, so each client has its own snapshot
+type NodeIDHash struct{}
+
+// ID ...
+func (NodeIDHash) ID(node *corev3.Node) string {
+	return node.GetId()
+}
+
+// NodeClusterHash ... groups the clients by the cluster of their node, e.g. the name of their service
+type NodeClusterHash struct{}
+
+// ID ...
+func (NodeClusterHash) ID(node *corev3.Node) string {
+	return node.GetCluster()
+}
+
+// NodeMetadataHash ... groups the clients by the string value of a key of their node metadata, e.g. their namespace or team
+type NodeMetadataHash struct {
+	Key string
+}
+
+// ID ... the clients without the key, or of which value is not a string, share the empty group
+func (h NodeMetadataHash) ID(node *corev3.Node) string {
+	return node.GetMetadata().GetFields()[h.Key].GetStringValue()
+}
+
+// NodeLocalityHash ... groups the clients by the region/zone/sub_zone of their node
+type NodeLocalityHash struct{}
+
+// ID ...
+func (NodeLocalityHash) ID(node *corev3.Node) string {
+	locality := node.GetLocality()
+	return strings.Join([]string{locality.GetRegion(), locality.GetZone(), locality.GetSubZone()}, "/")
+}
+
+// NewNodeHash ...
+// create the NodeHash of the strategy, either `default`, `id`, `cluster`, `metadata` or `locality`,
+// the metadataKey is only used by the `metadata` strategy
+func NewNodeHash(strategy string, metadataKey string) (cachev3.NodeHash, error) {
+	switch strategy {
+	case "", "default":
+		return DefaultNodeID{}, nil
+	case "id":
+		return NodeIDHash{}, nil
+	case "cluster":
+		return NodeClusterHash{}, nil
+	case "metadata":
+		if metadataKey == "" {
+			return nil, fmt.Errorf("node hash %q requires a metadata key", strategy)
+		}
+		return NodeMetadataHash{Key: metadataKey}, nil
+	case "locality":
+		return NodeLocalityHash{}, nil
+	default:
+		return nil, fmt.Errorf("unknown node hash %q", strategy)
+	}
+}
@@ -0,0 +1,195 @@
+package snapshots
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	discoverygrpc "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	resourcev3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/sifer169966/go-xds/metrics"
+	otelmetric "go.opentelemetry.io/otel/metric"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/types/known/anypb"
+	"k8s.io/klog/v2"
+)
+
+// persistFormat ... the directory of the files of the current format, another format must be written into its own directory
+const persistFormat = "v1"
+
+// persistence ...
+// persists the latest resources of each source into its own file, so that the last good resources could be served
+// on boot until the source sets the live ones. a file is a sequence of the size delimited DiscoveryResponses of each type url,
+// it is written into a temporary file that replaces the previous one by a rename to never leave a partial file behind.
+// the secrets are never persisted to not leave their private keys on the disk
+type persistence struct {
+	dir string
+	// maxAge is the maximum age of the restored resources, they are neither restored nor served any longer once they are older
+	maxAge time.Duration
+}
+
+// sourcePath ... the file of the source, the name is escaped since it could contain a slash, e.g. LDS/RDS/CDS
+func (p *persistence) sourcePath(name string) string {
+	return filepath.Join(p.dir, persistFormat, url.PathEscape(name)+".pb")
+}
+
+// save ... replace the file of the source by its current resources
+func (p *persistence) save(src *source) error {
+	path := p.sourcePath(src.name)
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	typeURLs := make([]string, 0, len(src.resources))
+	for typeURL := range src.resources {
+		if typeURL != resourcev3.SecretType {
+			typeURLs = append(typeURLs, typeURL)
+		}
+	}
+	slices.Sort(typeURLs)
+	for _, typeURL := range typeURLs {
+		resp := &discoverygrpc.DiscoveryResponse{
+			VersionInfo: src.version,
+			TypeUrl:     typeURL,
+		}
+		for _, res := range src.resources[typeURL] {
+			a, err := anypb.New(res)
+			if err != nil {
+				return err
+			}
+			resp.Resources = append(resp.Resources, a)
+		}
+		_, err = protodelim.MarshalTo(w, resp)
+		if err != nil {
+			return err
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// errPersistExpired ... the persisted resources are older than the maximum age
+var errPersistExpired = errors.New("persisted resources are expired")
+
+// load ... read the resources of the source that have been persisted and the time that they were saved
+func (p *persistence) load(name string) (string, map[string][]types.Resource, time.Time, error) {
+	f, err := os.Open(p.sourcePath(name))
+	if err != nil {
+		return "", nil, time.Time{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", nil, time.Time{}, err
+	}
+	savedAt := info.ModTime()
+	if p.maxAge > 0 && time.Since(savedAt) > p.maxAge {
+		return "", nil, savedAt, errPersistExpired
+	}
+	r := bufio.NewReader(f)
+	version := ""
+	resources := map[string][]types.Resource{}
+	for {
+		resp := &discoverygrpc.DiscoveryResponse{}
+		err := protodelim.UnmarshalFrom(r, resp)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", nil, savedAt, err
+		}
+		version = resp.GetVersionInfo()
+		for _, a := range resp.GetResources() {
+			res, err := a.UnmarshalNew()
+			if err != nil {
+				return "", nil, savedAt, err
+			}
+			resources[resp.GetTypeUrl()] = append(resources[resp.GetTypeUrl()], res)
+		}
+	}
+	return version, resources, savedAt, nil
+}
+
+// restore ...
+// set the persisted resources of the source until it sets the live ones, they are removed once they reach the maximum age.
+// the caller must hold the mu
+func (s *Snapshot) restore(src *source) {
+	version, resources, savedAt, err := s.persist.load(src.name)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		klog.Warning("could not restore the persisted resources", "source", src.name, "savedAt", savedAt, "err", err)
+		return
+	}
+	src.version = version
+	src.resources = resources
+	src.restoredAt = savedAt
+	klog.Info("restored the persisted resources", "source", src.name, "version", version, "savedAt", savedAt)
+	for kind := range resourceKinds(src.resources) {
+		s.rebuild(context.Background(), kind, version)
+	}
+	if s.persist.maxAge > 0 {
+		time.AfterFunc(s.persist.maxAge-time.Since(savedAt), func() {
+			s.expire(src, savedAt)
+		})
+	}
+}
+
+// expire ... remove the restored resources of the source if it has not set the live ones yet
+func (s *Snapshot) expire(src *source, restoredAt time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !src.restoredAt.Equal(restoredAt) {
+		return
+	}
+	klog.Warning("the restored resources are expired before the source has set the live ones", "source", src.name, "savedAt", restoredAt)
+	kinds := resourceKinds(src.resources)
+	src.resources = map[string][]types.Resource{}
+	src.restoredAt = time.Time{}
+	for kind := range kinds {
+		s.rebuild(context.Background(), kind, src.version)
+	}
+}
+
+// registerStalenessGauge ... observe the age of the restored resources of each source that is still serving them
+func (s *Snapshot) registerStalenessGauge() {
+	meter := metrics.GetGlobalMeter()
+	meter.Int64ObservableGauge("xds_snapshot_restored_staleness_seconds", otelmetric.WithInt64Callback(func(_ context.Context, o otelmetric.Int64Observer) error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, src := range s.sources {
+			var age int64
+			if !src.restoredAt.IsZero() {
+				age = int64(time.Since(src.restoredAt).Seconds())
+			}
+			o.Observe(age, otelmetric.WithAttributes(metrics.SourceAttrKey.String(src.name)))
+		}
+		return nil
+	}))
+}
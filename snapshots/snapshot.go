@@ -2,11 +2,12 @@ package snapshots
 
 import (
 	"context"
+	"sync"
+	"time"
 
 	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
 	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
 	resourcev3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
-	"k8s.io/klog/v2"
 )
 
 const (
@@ -14,6 +15,7 @@ const (
 	resourceKindRDS   = "RDS"
 	resourceKindCDS   = "CDS"
 	resourceKindEDS   = "EDS"
+	resourceKindSDS   = "SDS"
 	resourceKindMixed = "LDS/RDS/CDS"
 )
 
@@ -25,7 +27,48 @@ type SnapshotSetter interface {
 type Snapshot struct {
 	muxCache           cachev3.MuxCache
 	mixedSnapshotCache cachev3.SnapshotCache
-	edsSnapshotCache   cachev3.SnapshotCache
+	// linearCaches serve the resources of their type urls instead of the snapshot caches
+	linearCaches   map[string]*linearCache
+	edsConsistency *edsConsistency
+	// mu guards the sources and serializes the snapshot updates
+	mu      sync.Mutex
+	sources []*source
+	// mixedSource and edsSource are the sources of the resources that are set by the Set
+	mixedSource SnapshotSetter
+	edsSource   SnapshotSetter
+	nodeHash    cachev3.NodeHash
+	filter      ResourceFilter
+	// merged are the latest merged resources of each kind, the snapshot of each group is built from them
+	merged map[string]mergedResources
+	// groupsMu guards the groups, it is held after the mu
+	groupsMu sync.RWMutex
+	// groups are the groups of the clients that have their own snapshots
+	groups map[string]struct{}
+	// watchesMu guards the watches, it is held after the groupsMu
+	watchesMu sync.Mutex
+	// watches are the open watches of each group, a group without any is evicted after the groupIdleTTL
+	watches      map[string]*groupWatches
+	groupIdleTTL time.Duration
+	persist      *persistence
+}
+
+// Config ... the grouping of the clients into the snapshots
+type Config struct {
+	// NodeHash groups the clients that share the same snapshot, every client shares the default one if it is nil
+	NodeHash cachev3.NodeHash
+	// Filter filters the resources of the snapshot of each group, every group sees every resource if it is nil
+	Filter ResourceFilter
+	// LinearClusters serves the cds resources of the delta clients by their own versions as the eds resources.
+	// the SotW clients are always served along with the lds and rds resources since a SotW response of the cds
+	// must have every cluster, so they are also served that way without it
+	LinearClusters bool
+	// GroupIdleTTL evicts a group and its snapshots once its clients have had no stream for it, the groups are never evicted if it is zero
+	GroupIdleTTL time.Duration
+	// PersistDir persists the resources of each source into the directory to serve them on boot until the live ones are set,
+	// nothing is persisted if it is empty
+	PersistDir string
+	// PersistMaxAge is the maximum age of the persisted resources to be served, zero means no limit
+	PersistMaxAge time.Duration
 }
 
 func getResourceKeyName(typeURL string) string {
@@ -34,33 +77,60 @@ func getResourceKeyName(typeURL string) string {
 		return resourceKindMixed
 	case resourcev3.EndpointType:
 		return resourceKindEDS
+	case resourcev3.SecretType:
+		return resourceKindSDS
 	default:
 		return ""
 	}
 }
 
 // New ...
-// create a new instance of snapshot to capture and hold the discovery information at a point of time
-func New() *Snapshot {
-	mixedSnapshotCache := cachev3.NewSnapshotCache(false, DefaultNodeID{}, nil)
-	edsSnapshotCache := cachev3.NewSnapshotCache(false, DefaultNodeID{}, nil)
-	muxCache := cachev3.MuxCache{
+// create a new instance of snapshot to capture and hold the discovery information at a point of time,
+// the clients are grouped by the cfg.NodeHash and each group has its own snapshot.
+// the eds and sds resources are served from the linear caches so that only the changed ones are sent to the clients,
+// e.g. only the rotated secrets
+func New(cfg Config) *Snapshot {
+	if cfg.NodeHash == nil {
+		cfg.NodeHash = DefaultNodeID{}
+	}
+	out := &Snapshot{
+		mixedSnapshotCache: cachev3.NewSnapshotCache(false, cfg.NodeHash, nil),
+		linearCaches:       map[string]*linearCache{},
+		edsConsistency:     newEDSConsistency(),
+		nodeHash:           cfg.NodeHash,
+		filter:             cfg.Filter,
+		merged:             map[string]mergedResources{},
+		// predefined the default group in case there is no request from the client yet to provide the information for our monitoring
+		groups:       map[string]struct{}{DefaultNodeID{}.ID(nil): {}},
+		watches:      map[string]*groupWatches{},
+		groupIdleTTL: cfg.GroupIdleTTL,
+	}
+	if cfg.PersistDir != "" {
+		out.persist = &persistence{dir: cfg.PersistDir, maxAge: cfg.PersistMaxAge}
+		out.registerStalenessGauge()
+	}
+	out.linearCaches[resourcev3.EndpointType] = newLinearCache(out, resourcev3.EndpointType, false)
+	out.linearCaches[resourcev3.SecretType] = newLinearCache(out, resourcev3.SecretType, false)
+	if cfg.LinearClusters {
+		out.linearCaches[resourcev3.ClusterType] = newLinearCache(out, resourcev3.ClusterType, true)
+	}
+	out.muxCache = cachev3.MuxCache{
 		Classify: func(r *cachev3.Request) string {
-			return getResourceKeyName(r.TypeUrl)
+			return out.classify(r.TypeUrl, false)
 		},
 		ClassifyDelta: func(r *cachev3.DeltaRequest) string {
-			return getResourceKeyName(r.TypeUrl)
+			return out.classify(r.TypeUrl, true)
 		},
 		Caches: map[string]cachev3.Cache{
-			resourceKindMixed: mixedSnapshotCache,
-			resourceKindEDS:   edsSnapshotCache,
+			resourceKindMixed: groupCache{SnapshotCache: out.mixedSnapshotCache, snap: out},
 		},
 	}
-	return &Snapshot{
-		muxCache:           muxCache,
-		mixedSnapshotCache: mixedSnapshotCache,
-		edsSnapshotCache:   edsSnapshotCache,
+	for typeURL, lc := range out.linearCaches {
+		out.muxCache.Caches[out.classify(typeURL, true)] = lc
 	}
+	out.mixedSource = out.Source(resourceKindMixed, 0)
+	out.edsSource = out.Source(resourceKindEDS, 0)
+	return out
 }
 
 func (s *Snapshot) MuxCache() *cachev3.MuxCache {
@@ -69,42 +139,22 @@ func (s *Snapshot) MuxCache() *cachev3.MuxCache {
 
 // Set ...
 // set the mixed snapshot(multiplex of LDS, RDS, CDS) and a separate snapshot for eds
-// if the src is EDS then set the EDS snapshot, otherwise, set the resource into mixed snapshot
+// if the src is EDS then set the EDS snapshot, otherwise, set the resource into mixed snapshot.
+// the reflectors that share the snapshot should rather set their resources by their own Source
 func (s *Snapshot) Set(ctx context.Context, version string, src []types.Resource) {
-	srcMap := resourcesToMap(src)
-	snapshot, err := cachev3.NewSnapshot(version, srcMap)
-	if err != nil {
-		klog.Error("could not create a new snapshot", "version", version, "src", srcMap)
-		return
-	}
-	//TODO: hasing resources to compare with the previous snapshot
-	if _, ok := srcMap[resourcev3.EndpointType]; ok {
-		s.setEDSSnapshotCache(ctx, snapshot)
-		klog.Info("set eds snapshot to a new version", "version", version)
-	} else {
-		s.setMixedSnapshotCache(ctx, snapshot)
-		klog.Info("set mixed snapshot to a new version", "version", version)
-	}
-}
-
-func (s *Snapshot) setEDSSnapshotCache(ctx context.Context, snap *cachev3.Snapshot) {
-	nodeIDs := s.edsSnapshotCache.GetStatusKeys()
-	// predefined the node ID in case there is no request from the client yet to provide the information for our monitoring
-	if len(nodeIDs) == 0 {
-		nodeIDs = append(nodeIDs, DefaultNodeID{}.ID(nil))
-	}
-	for _, v := range nodeIDs {
-		s.edsSnapshotCache.SetSnapshot(ctx, v, snap)
+	for _, res := range src {
+		if resourceType(res) == resourcev3.EndpointType {
+			s.edsSource.Set(ctx, version, src)
+			return
+		}
 	}
+	s.mixedSource.Set(ctx, version, src)
 }
 
-func (s *Snapshot) setMixedSnapshotCache(ctx context.Context, snap *cachev3.Snapshot) {
-	nodeIDs := s.mixedSnapshotCache.GetStatusKeys()
-	// predefined the node ID in case there is no request from the client yet to provide the information for our monitoring
-	if len(nodeIDs) == 0 {
-		nodeIDs = append(nodeIDs, DefaultNodeID{}.ID(nil))
-	}
-	for _, v := range nodeIDs {
-		s.mixedSnapshotCache.SetSnapshot(ctx, v, snap)
+// classify ... the key of the cache of the type url in the mux cache for the delta or the SotW requests
+func (s *Snapshot) classify(typeURL string, delta bool) string {
+	if lc, ok := s.linearCaches[typeURL]; ok && delta && typeURL == resourcev3.ClusterType && lc.deltaOnly {
+		return resourceKindCDS
 	}
+	return getResourceKeyName(typeURL)
 }
@@ -0,0 +1,156 @@
+package snapshots
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	resourcev3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"k8s.io/klog/v2"
+)
+
+// source ... the latest resources that have been set by a SnapshotSetter of the Snapshot.Source
+type source struct {
+	name      string
+	priority  int
+	version   string
+	resources map[string][]types.Resource
+	// restoredAt is the time that the persisted resources were saved until the source sets the live ones
+	restoredAt time.Time
+}
+
+// sourceSetter ... set the resources of a source into the snapshot
+type sourceSetter struct {
+	snap   *Snapshot
+	source *source
+}
+
+// Set ... replace every resource of the source, the resources that are not set anymore are removed from the snapshots
+func (s *sourceSetter) Set(ctx context.Context, version string, src []types.Resource) {
+	s.snap.setSource(ctx, s.source, version, src)
+}
+
+// Source ...
+// create a SnapshotSetter of which resources are merged with the ones of the other sources into the snapshots.
+// a resource of a source overrides the one of the same type and name of the sources that have a lower priority.
+// the persisted resources of the source are served until it sets the live ones
+func (s *Snapshot) Source(name string, priority int) SnapshotSetter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	src := &source{
+		name:      name,
+		priority:  priority,
+		resources: map[string][]types.Resource{},
+	}
+	s.sources = append(s.sources, src)
+	slices.SortStableFunc(s.sources, func(a, b *source) int {
+		return cmp.Compare(a.priority, b.priority)
+	})
+	if s.persist != nil {
+		s.restore(src)
+	}
+	return &sourceSetter{snap: s, source: src}
+}
+
+func (s *Snapshot) setSource(ctx context.Context, src *source, version string, resources []types.Resource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// rebuild the snapshots of both the previous and the current resources to remove the ones that are not set anymore
+	kinds := resourceKinds(src.resources)
+	src.version = version
+	src.resources = resourcesToMap(resources)
+	src.restoredAt = time.Time{}
+	for kind := range resourceKinds(src.resources) {
+		kinds[kind] = struct{}{}
+	}
+	if s.persist != nil {
+		err := s.persist.save(src)
+		if err != nil {
+			klog.Error("could not persist the resources", "source", src.name, "version", version, "err", err)
+		}
+	}
+	for kind := range kinds {
+		s.rebuild(ctx, kind, version)
+	}
+}
+
+// rebuild ...
+// merge the resources of every source into the snapshot of the kind, the caller must hold the mu.
+// the version of the snapshot consists of the versions of the sources that have resources of the kind
+func (s *Snapshot) rebuild(ctx context.Context, kind string, fallbackVersion string) {
+	merged := map[string]map[string]types.Resource{}
+	var versions []string
+	for _, src := range s.sources {
+		contributed := false
+		for typeURL, resources := range src.resources {
+			if getResourceKeyName(typeURL) != kind {
+				continue
+			}
+			if _, ok := merged[typeURL]; !ok {
+				merged[typeURL] = map[string]types.Resource{}
+			}
+			for _, res := range resources {
+				name := cachev3.GetResourceName(res)
+				if _, ok := merged[typeURL][name]; ok {
+					klog.V(1).Info("resource is overridden by a source", "source", src.name, "typeURL", typeURL, "name", name)
+				}
+				merged[typeURL][name] = res
+			}
+			contributed = true
+		}
+		if contributed {
+			versions = append(versions, src.version)
+		}
+	}
+	version := strings.Join(versions, ".")
+	if version == "" {
+		version = fallbackVersion
+	}
+	resources := map[string][]types.Resource{}
+	for typeURL, byName := range merged {
+		names := make([]string, 0, len(byName))
+		for name := range byName {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			resources[typeURL] = append(resources[typeURL], byName[name])
+		}
+	}
+	s.merged[kind] = mergedResources{version: version, resources: resources}
+	switch kind {
+	case resourceKindEDS:
+		s.publish(ctx, kind)
+		klog.Info("set eds snapshot to a new version", "version", version)
+		s.edsConsistency.setLoadAssignments(resources[resourcev3.EndpointType])
+	case resourceKindMixed:
+		s.publish(ctx, kind)
+		klog.Info("set mixed snapshot to a new version", "version", version)
+		s.edsConsistency.setClusters(resources[resourcev3.ClusterType])
+		// the eds resources that the groups see rely on their cds resources
+		if _, ok := s.merged[resourceKindEDS]; ok && s.filter != nil {
+			s.publish(ctx, resourceKindEDS)
+		}
+	case resourceKindSDS:
+		s.publish(ctx, kind)
+		klog.Info("set sds snapshot to a new version", "version", version)
+	}
+}
+
+// resourceKinds ... the kinds of the snapshots that the resources belong to
+func resourceKinds(resources map[string][]types.Resource) map[string]struct{} {
+	out := map[string]struct{}{}
+	for typeURL := range resources {
+		kind := getResourceKeyName(typeURL)
+		if kind == "" {
+			klog.Error("resource type is not served by any snapshot", "typeURL", typeURL)
+			continue
+		}
+		out[kind] = struct{}{}
+	}
+	return out
+}